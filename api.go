@@ -2,46 +2,94 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"math"
+	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	gin "github.com/gin-gonic/gin"
 )
 
+var apiThrottler *Throttler
+
 func errorResponse(status int, err error, c *gin.Context) {
 	result := map[string]string{"error": err.Error()}
 	c.JSON(status, result)
 }
 
 func performRun(run *Run) (*RunResult, error) {
-	// Try to get a warmed-up container for the run
-	if run.Request.Clean == false && pools[run.Request.Image] != nil {
-		container, err := pools[run.Request.Image].Get()
+	if run.Request.Manifest != "" {
+		if err := run.InstallDependencies(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Try to get a warmed-up container for the run. Pool containers are created
+	// with default memory limit and could not serve runs with a lower one, mount
+	// a namespace or dependencies.
+	pool := getPool(run.Request.Image)
+	if run.Request.Clean == false && pool != nil && run.MemoryLimit() == run.Config.MemoryLimit && run.Namespace == nil && run.Request.Manifest == "" {
+		span := run.Trace.StartSpan("pool_get")
+		container, err := pool.Get()
+		span.Finish(err)
 
 		if err == nil {
-			log.Println("got warmed-up container for image:", run.Request.Image, container.ID)
+			poolHits.Inc(run.Request.Image)
+			run.Log().Debug("got warmed-up container", "container_id", container.ID)
 			result, err := run.StartExecWithTimeout(container)
 			return result, err
 		}
+
+		poolMisses.Inc(run.Request.Image)
 	}
 
-	log.Println("setting up container for image:", run.Request.Image)
+	run.Log().Debug("setting up container")
+	ts := time.Now()
 	if err := run.Setup(); err != nil {
 		return nil, err
 	}
+	runDuration.ObserveSince(ts, "setup")
 
 	return run.StartWithTimeout()
 }
 
 func HandleRun(c *gin.Context) {
+	trace := getTrace(c)
+
+	span := trace.StartSpan("parse_request")
 	req, err := ParseRequest(c.Request)
+	span.Finish(err)
+
 	if err != nil {
+		setServerTiming(c, trace)
 		errorResponse(400, err, c)
 		return
 	}
 
+	handleRunRequest(c, req)
+}
+
+// handleRunRequest performs a parsed run request and writes its result
+func handleRunRequest(c *gin.Context, req *Request) {
+	trace := getTrace(c)
+
+	key := getApiKey(c)
+	if key != nil {
+		if key.Namespace != "" {
+			req.NamespaceId = key.Namespace
+		}
+
+		if err := key.Limits.Apply(req); err != nil {
+			errorResponse(403, err, c)
+			return
+		}
+	}
+
+	if !checkImageAvailable(c, req.Image) {
+		return
+	}
+
 	config, exists := c.Get("config")
 	if !exists {
 		errorResponse(400, fmt.Errorf("Cant get config"), c)
@@ -54,94 +102,292 @@ func HandleRun(c *gin.Context) {
 		return
 	}
 
-	run := NewRun(config.(*Config), client.(*docker.Client), req)
+	if req.Share {
+		if err := checkSnippet(config.(*Config), req); err != nil {
+			errorResponse(snippetErrorStatus(err), err, c)
+			return
+		}
+	}
+
+	subject := usageSubject(key, req.NamespaceId)
+	if !checkUsage(c, subject, usageQuotas(config.(*Config), key)) {
+		return
+	}
+
+	var namespace *Namespace
+	var err error
+	if namespaceStore != nil && req.NamespaceId != "" {
+		if namespace, err = openNamespace(c, req.NamespaceId); err != nil {
+			status := 400
+			switch err {
+			case errNamespaceBusy:
+				status = 409
+			case errNamespaceQuota, errNamespaceOwner:
+				status = 403
+			}
+
+			errorResponse(status, err, c)
+			return
+		}
+		defer namespaceStore.Release(namespace.Name)
+	}
+
+	run := NewRun(config.(*Config), client.(*docker.Client), req, clientIP(c))
+	run.Trace = trace
+	run.Namespace = namespace
+	c.Header("X-Run-Id", run.Id)
+
+	if err := runTracker.Begin(run); err != nil {
+		c.Header("Retry-After", strconv.Itoa(drainRetryAfter))
+		errorResponse(503, err, c)
+		return
+	}
+
+	c.Set("run", run)
+
+	defer runTracker.End(run)
 	defer run.Destroy()
 
+	// Run is stopped as soon as it writes past the namespace quota
+	var stopWatch func() bool
+	if namespace != nil {
+		stopWatch = namespaceStore.Watch(namespace, func() {
+			run.Log().Warn("namespace quota exceeded, stopping run")
+			run.Destroy()
+		})
+	}
+
+	ts := time.Now()
 	result, err := performRun(run)
+	if stopWatch != nil && stopWatch() {
+		err = errNamespaceQuota
+	}
+	observeRun(req, result, err, ts)
+
+	if _, timeout := err.(*TimeoutError); err == nil || timeout || err == errNamespaceQuota {
+		usageTracker.Record(subject, runUsage(run, result, time.Since(ts)))
+	}
+
+	defer run.logAccess(c, result, err, ts)
+	defer recordRun(c, run, result, err, ts)
+	setServerTiming(c, trace)
+
+	if err == errNamespaceQuota {
+		errorResponse(403, err, c)
+		return
+	}
+
 	if err != nil {
 		errorResponse(400, err, c)
 		return
 	}
 
+	// Quota is checked before and during the run, but files written between
+	// checks could still exceed it. Output is withheld and further runs are
+	// rejected until files are deleted.
+	if namespace != nil {
+		if err := namespaceStore.CheckUsage(namespace); err != nil {
+			errorResponse(403, err, c)
+			return
+		}
+	}
+
+	if req.Share {
+		shareRun(c, req, result)
+	}
+
+	if len(req.Artifacts) > 0 {
+		artifacts, err := run.CollectArtifacts()
+		if err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+
+		writeArtifactsResult(c, run, result, artifacts)
+		return
+	}
+
+	writeRunResult(c, req, result)
+}
+
+func writeRunResult(c *gin.Context, req *Request, result *RunResult) {
 	c.Header("X-Run-Command", req.Command)
 	c.Header("X-Run-ExitCode", strconv.Itoa(result.ExitCode))
 	c.Header("X-Run-Duration", result.Duration)
 
+	if result.ImageDigest != "" {
+		c.Header("X-Run-Image-Digest", result.ImageDigest)
+	}
+
 	c.Data(200, req.Format, result.Output)
 }
 
-func HandleConfig(c *gin.Context) {
-	c.JSON(200, Extensions)
-}
+func HandleReload(c *gin.Context) {
+	client, exists := c.Get("client")
+	if !exists {
+		errorResponse(400, fmt.Errorf("Cant get client"), c)
+		return
+	}
 
-func authMiddleware(config *Config) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if config.ApiToken != "" {
-			token := c.Request.FormValue("api_token")
+	if err := Reload(client.(*docker.Client)); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
 
-			if token != config.ApiToken {
-				errorResponse(400, fmt.Errorf("Api token is invalid"), c)
-				c.Abort()
-				return
-			}
-		}
+	c.JSON(200, map[string]int{"languages": len(GetLanguages())})
+}
 
-		c.Next()
-	}
+func setRateLimitHeaders(c *gin.Context, status *ThrottleStatus) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.Reset.Seconds()))))
 }
 
 func throttleMiddleware(throttler *Throttler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := strings.Split(c.Request.RemoteAddr, ":")[0]
+		ip := clientIP(c)
+		key := getApiKey(c)
 
-		// Bypass throttling for whitelisted IPs
-		if throttler.Whitelisted(ip) {
+		// Bypass throttling for whitelisted IPs, api keys have their own limits
+		if key == nil && throttler.Whitelisted(ip) {
 			c.Next()
 			return
 		}
 
-		if err := throttler.Add(ip); err != nil {
+		namespace := normalizeString(c.Request.FormValue("namespace"))
+		if key != nil && key.Namespace != "" {
+			namespace = key.Namespace
+		}
+
+		id, limits := throttler.Subject(ip, namespace, key)
+
+		status, err := throttler.Add(id, limits)
+
+		// Let requests through when the throttle backend is unavailable
+		if _, ok := err.(*ThrottleError); err != nil && !ok {
+			logger.Error("throttle backend failed", "id", id, "error", err)
+			c.Next()
+			return
+		}
+
+		setRateLimitHeaders(c, status)
+
+		if err != nil {
+			throttleRejections.Inc()
+			c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(status.RetryAfter.Seconds())))))
 			errorResponse(429, err, c)
 			c.Abort()
 			return
 		}
 
 		c.Next()
-		throttler.Remove(ip)
+		throttler.Remove(id)
 	}
 }
 
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, traceparent")
 		c.Header("Access-Control-Expose-Headers", "*")
+
+		// Preflight requests carry no credentials
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+		}
 	}
 }
 
-func RunApi(config *Config, client *docker.Client) {
-	throttler := NewThrottler(config.ThrottleConcurrency, config.ThrottleQuota)
-	throttler.SetWhitelist(config.ThrottleWhitelist)
-	throttler.StartPeriodicFlush()
-
-	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
+func NewRouter(client *docker.Client, throttler *Throttler) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(requestLogMiddleware())
 
 	v1 := router.Group("/api/v1/")
 	{
-		v1.Use(authMiddleware(config))
 		v1.Use(corsMiddleware())
+		v1.Use(traceMiddleware())
+		v1.Use(authMiddleware())
 		v1.Use(throttleMiddleware(throttler))
 
 		v1.Use(func(c *gin.Context) {
-			c.Set("config", config)
+			c.Set("config", CurrentConfig())
 			c.Set("client", client)
 		})
 
+		v1.OPTIONS("/*path", func(c *gin.Context) {})
 		v1.GET("/config", HandleConfig)
-		v1.POST("/run", HandleRun)
+		v1.GET("/usage", HandleUsage)
+		v1.GET("/runs", HandleListRuns)
+		v1.GET("/runs/:id", HandleGetRun)
+		v1.GET("/runs/:id/artifacts/*name", HandleArtifact)
+		v1.POST("/snippets", HandleCreateSnippet)
+		v1.GET("/snippets/:id", HandleSnippet)
+		v1.POST("/snippets/:id/run", drainMiddleware(), HandleSnippetRun)
+		v1.POST("/sessions", drainMiddleware(), HandleCreateSession)
+		v1.GET("/sessions/:id", HandleSession)
+		v1.POST("/sessions/:id/run", drainMiddleware(), HandleSessionRun)
+		v1.GET("/sessions/:id/files/*path", HandleSessionFile)
+		v1.DELETE("/sessions/:id", HandleCloseSession)
+		v1.GET("/namespaces/:name", HandleNamespace)
+		v1.DELETE("/namespaces/:name", HandleDeleteNamespace)
+		v1.GET("/namespaces/:name/files/*path", HandleNamespaceFile)
+		v1.DELETE("/namespaces/:name/files/*path", HandleDeleteNamespaceFile)
+		v1.POST("/run", drainMiddleware(), HandleRun)
+	}
+
+	router.GET("/healthz", HandleHealth)
+	router.GET("/metrics", HandleMetrics)
+	router.GET("/readyz", func(c *gin.Context) {
+		c.Set("client", client)
+	}, HandleReady)
+
+	admin := router.Group("/api/v1/admin/")
+	{
+		admin.Use(adminMiddleware())
+
+		admin.Use(func(c *gin.Context) {
+			c.Set("client", client)
+		})
+
+		admin.POST("/reload", HandleReload)
+		admin.GET("/keys", HandleListKeys)
+		admin.POST("/keys", HandleCreateKey)
+		admin.POST("/keys/:id", HandleUpdateKey)
+		admin.POST("/keys/:id/rotate", HandleRotateKey)
+		admin.DELETE("/keys/:id", HandleRevokeKey)
+		admin.GET("/builds", HandleListBuilds)
+		admin.POST("/builds", HandleCreateBuild)
+		admin.GET("/builds/:id", HandleBuild)
+		admin.GET("/builds/:id/log", HandleBuildLog)
+		admin.GET("/images", HandleImages)
+	}
+
+	return router
+}
+
+func RunApi(config *Config, client *docker.Client) {
+	throttler := NewThrottler(NewThrottleLimits(config), NewThrottleBackend(config))
+	throttler.Configure(config)
+	throttler.SetWhitelist(config.ThrottleWhitelist)
+	apiThrottler = throttler
+
+	gin.SetMode(gin.ReleaseMode)
+
+	server := &http.Server{
+		Addr:    config.Listen,
+		Handler: NewRouter(client, throttler),
+	}
+
+	done := make(chan bool)
+	go watchShutdownSignal(server, done)
+
+	logger.Info("starting server", "listen", config.Listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fatal("server failed", err)
 	}
 
-	fmt.Println("starting server on", config.Listen)
-	router.Run(config.Listen)
+	<-done
+	logger.Info("server stopped")
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Maximum number of artifact patterns in a request
+const maxArtifactPatterns = 10
+
+// Artifact is a file produced by a run. Content is returned inline, stored
+// artifacts have an url instead.
+type Artifact struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Content []byte `json:"content,omitempty"`
+	Url     string `json:"url,omitempty"`
+}
+
+// ArtifactStore keeps artifacts of completed runs for artifact_ttl seconds
+type ArtifactStore struct {
+	Path string
+}
+
+var artifactStore *ArtifactStore
+
+// parseArtifactPatterns accepts repeated or comma separated glob patterns
+// relative to /code
+func parseArtifactPatterns(values []string) ([]string, error) {
+	patterns := []string{}
+
+	for _, value := range values {
+		for _, pattern := range strings.Split(value, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+
+			if filepath.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, "../") || strings.Contains(pattern, "/../") {
+				return nil, fmt.Errorf("Invalid artifact pattern: %s", pattern)
+			}
+
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid artifact pattern: %s", pattern)
+			}
+
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	if len(patterns) > maxArtifactPatterns {
+		return nil, fmt.Errorf("Too many artifact patterns, maximum is %d", maxArtifactPatterns)
+	}
+
+	return patterns, nil
+}
+
+func validArtifactsFormat(format string) bool {
+	switch format {
+	case "json", "multipart", "store":
+		return true
+	}
+
+	return false
+}
+
+// CollectArtifacts reads files matching the request patterns. Each pattern
+// could match up to ArtifactMaxFiles files of ArtifactMaxBytes bytes in total.
+func CollectArtifacts(config *Config, root string, patterns []string) ([]*Artifact, error) {
+	artifacts := []*Artifact{}
+	seen := map[string]bool{}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(matches)
+
+		count := 0
+		var size int64
+
+		for _, match := range matches {
+			name, err := filepath.Rel(root, match)
+			if err != nil || seen[name] {
+				continue
+			}
+
+			file, info, err := openFile(root, name)
+			if err != nil {
+				// Directories and special files are skipped
+				continue
+			}
+
+			count++
+			size += info.Size()
+
+			if count > config.ArtifactMaxFiles {
+				file.Close()
+				return nil, fmt.Errorf("Artifact pattern %s matches more than %d files", pattern, config.ArtifactMaxFiles)
+			}
+
+			if size > config.ArtifactMaxBytes {
+				file.Close()
+				return nil, fmt.Errorf("Artifacts matching %s exceed %d bytes", pattern, config.ArtifactMaxBytes)
+			}
+
+			// File could still grow if processes are left running in the container
+			content, err := ioutil.ReadAll(io.LimitReader(file, info.Size()))
+			file.Close()
+
+			if err != nil {
+				return nil, err
+			}
+
+			seen[name] = true
+			artifacts = append(artifacts, &Artifact{
+				Name:    filepath.ToSlash(name),
+				Size:    int64(len(content)),
+				Content: content,
+			})
+		}
+	}
+
+	return artifacts, nil
+}
+
+// CollectArtifacts reads artifacts from the run code directory
+func (run *Run) CollectArtifacts() ([]*Artifact, error) {
+	span := run.Trace.StartSpan("collect_artifacts")
+
+	root := run.VolumePath
+	if run.Namespace != nil {
+		root = run.Namespace.Path
+	}
+
+	artifacts, err := CollectArtifacts(run.Config, root, run.Request.Artifacts)
+	span.Finish(err)
+
+	return artifacts, err
+}
+
+func NewArtifactStore(config *Config) (*ArtifactStore, error) {
+	store := &ArtifactStore{
+		Path: artifactsPath(config),
+	}
+
+	return store, os.MkdirAll(store.Path, 0755)
+}
+
+func artifactsPath(config *Config) string {
+	if config.ArtifactsPath != "" {
+		return config.ArtifactsPath
+	}
+
+	return filepath.Join(config.SharedPath, "artifacts")
+}
+
+// Save writes artifacts of a run and replaces their content with urls
+func (store *ArtifactStore) Save(runId string, artifacts []*Artifact) error {
+	dir := filepath.Join(store.Path, runId)
+
+	for _, artifact := range artifacts {
+		path := filepath.Join(dir, filepath.FromSlash(artifact.Name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path, artifact.Content, 0644); err != nil {
+			return err
+		}
+
+		artifact.Content = nil
+		artifact.Url = fmt.Sprintf("/api/v1/runs/%s/artifacts/%s", runId, artifact.Name)
+	}
+
+	return nil
+}
+
+// Cleanup removes artifacts of runs completed more than artifact_ttl ago
+func (store *ArtifactStore) Cleanup() {
+	ttl := CurrentConfig().ArtifactTTL
+
+	entries, err := ioutil.ReadDir(store.Path)
+	if err != nil {
+		logger.Error("cant list artifacts", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) < ttl {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(store.Path, entry.Name())); err != nil {
+			logger.Error("cant remove artifacts", "run_id", entry.Name(), "error", err)
+		}
+	}
+}
+
+func (store *ArtifactStore) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			store.Cleanup()
+		}
+	}()
+}
+
+// writeArtifactsResult responds with run output and artifacts in the format
+// requested by the client
+func writeArtifactsResult(c *gin.Context, run *Run, result *RunResult, artifacts []*Artifact) {
+	req := run.Request
+
+	c.Header("X-Run-Command", req.Command)
+	c.Header("X-Run-ExitCode", strconv.Itoa(result.ExitCode))
+	c.Header("X-Run-Duration", result.Duration)
+
+	if result.ImageDigest != "" {
+		c.Header("X-Run-Image-Digest", result.ImageDigest)
+	}
+
+	if req.ArtifactsFormat == "multipart" {
+		writer := multipart.NewWriter(c.Writer)
+		c.Header("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+		c.Status(200)
+
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {req.Format},
+			"Content-Disposition": {`inline; name="output"`},
+		})
+		part.Write(result.Output)
+
+		for _, artifact := range artifacts {
+			part, _ := writer.CreatePart(textproto.MIMEHeader{
+				"Content-Type":        {"application/octet-stream"},
+				"Content-Disposition": {fmt.Sprintf(`attachment; filename=%q`, artifact.Name)},
+			})
+			part.Write(artifact.Content)
+		}
+
+		writer.Close()
+		return
+	}
+
+	if req.ArtifactsFormat == "store" {
+		if artifactStore == nil {
+			errorResponse(400, fmt.Errorf("Artifact storage is not enabled"), c)
+			return
+		}
+
+		if err := artifactStore.Save(run.Id, artifacts); err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+	}
+
+	c.JSON(200, map[string]interface{}{
+		"exit_code": result.ExitCode,
+		"output":    string(result.Output),
+		"artifacts": artifacts,
+	})
+}
+
+func HandleArtifact(c *gin.Context) {
+	if artifactStore == nil {
+		errorResponse(404, fmt.Errorf("Artifact storage is not enabled"), c)
+		return
+	}
+
+	id := c.Param("id")
+	if !RunIdRegexp.MatchString(id) {
+		errorResponse(404, fmt.Errorf("Artifact does not exist"), c)
+		return
+	}
+
+	serveFile(c, filepath.Join(artifactStore.Path, id), c.Param("name"))
+}
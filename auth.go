@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Maximum request body size covered by HMAC signature
+const maxSignedBodySize = 10 << 20
+
+// SignatureCache remembers signatures of accepted requests until their
+// timestamps fall out of the allowed skew, so a captured request could not be
+// replayed
+type SignatureCache struct {
+	seen    map[string]time.Time
+	cleaned time.Time
+	sync.Mutex
+}
+
+var signatureCache = NewSignatureCache()
+
+func NewSignatureCache() *SignatureCache {
+	return &SignatureCache{
+		seen: map[string]time.Time{},
+	}
+}
+
+// Add records the signature until it expires, returns false when it was
+// already used
+func (cache *SignatureCache) Add(signature string, expires time.Time) bool {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(cache.cleaned) > time.Minute {
+		for sig, ts := range cache.seen {
+			if now.After(ts) {
+				delete(cache.seen, sig)
+			}
+		}
+		cache.cleaned = now
+	}
+
+	if ts, ok := cache.seen[signature]; ok && !now.After(ts) {
+		return false
+	}
+
+	cache.seen[signature] = expires
+	return true
+}
+
+func unauthorizedResponse(err error, c *gin.Context) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="bitrun", error="invalid_token", error_description="%s"`, err.Error()))
+	errorResponse(401, err, c)
+	c.Abort()
+}
+
+// requestToken extracts a bearer token, falling back to api_token form value
+func requestToken(c *gin.Context) string {
+	header := c.Request.Header.Get("Authorization")
+
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return c.Request.FormValue("api_token")
+}
+
+// validGlobalToken checks the token against api_token or api_token_hash config
+func validGlobalToken(config *Config, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	if config.ApiTokenHash != "" {
+		return secureCompare(strings.ToLower(config.ApiTokenHash), hashToken(token))
+	}
+
+	if config.ApiToken != "" {
+		return secureCompare(hashToken(config.ApiToken), hashToken(token))
+	}
+
+	return false
+}
+
+func authRequired(config *Config) bool {
+	return config.ApiToken != "" || config.ApiTokenHash != "" || keyStore != nil ||
+		len(config.HmacSecrets) > 0 || getJwtVerifier() != nil
+}
+
+// requestSignature returns the hex HMAC-SHA256 of timestamp, method and request
+// uri, each followed by a newline, and the body
+func requestSignature(secret string, timestamp string, method string, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature validates HMAC-SHA256 signed requests, each signature is
+// accepted once:
+//
+//	X-Bitrun-Timestamp: <unix seconds>
+//	X-Bitrun-Signature: <secret name>:<hex hmac>
+func verifySignature(config *Config, c *gin.Context) error {
+	header := c.Request.Header.Get("X-Bitrun-Signature")
+	chunks := strings.SplitN(header, ":", 2)
+	if len(chunks) != 2 {
+		return fmt.Errorf("Signature is invalid")
+	}
+
+	secret, ok := config.HmacSecrets[chunks[0]]
+	if !ok {
+		return fmt.Errorf("Signature is invalid")
+	}
+
+	timestamp := c.Request.Header.Get("X-Bitrun-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Signature timestamp is invalid")
+	}
+
+	if math.Abs(float64(time.Now().Unix()-ts)) > config.HmacMaxSkew.Seconds() {
+		return fmt.Errorf("Signature is expired")
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodySize))
+	if err != nil {
+		return err
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := requestSignature(secret, timestamp, c.Request.Method, c.Request.URL.RequestURI(), body)
+	if !secureCompare(expected, strings.ToLower(chunks[1])) {
+		return fmt.Errorf("Signature is invalid")
+	}
+
+	// Requests are accepted within the skew on both sides of their timestamp
+	if !signatureCache.Add(chunks[0]+":"+expected, time.Unix(ts, 0).Add(config.HmacMaxSkew)) {
+		return fmt.Errorf("Signature was already used")
+	}
+
+	return nil
+}
+
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := CurrentConfig()
+
+		// Admin token grants access to all resources, e.g. run history
+		if c.Request.Header.Get("X-Admin-Token") != "" && validAdminToken(config, c) {
+			c.Set("admin", true)
+			c.Next()
+			return
+		}
+
+		if !authRequired(config) {
+			c.Next()
+			return
+		}
+
+		if len(config.HmacSecrets) > 0 && c.Request.Header.Get("X-Bitrun-Signature") != "" {
+			if err := verifySignature(config, c); err != nil {
+				unauthorizedResponse(err, c)
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		token := requestToken(c)
+		if token == "" {
+			unauthorizedResponse(fmt.Errorf("Api token is required"), c)
+			return
+		}
+
+		// Browser embeds use short-lived tokens issued by a trusted backend
+		if verifier := getJwtVerifier(); verifier != nil && looksLikeJwt(token) {
+			claims, err := verifier.Verify(token)
+			if err != nil {
+				unauthorizedResponse(err, c)
+				return
+			}
+
+			c.Set("api_key", claims.ApiKey())
+			c.Next()
+			return
+		}
+
+		if keyStore != nil {
+			if key := keyStore.FindByToken(token); key != nil {
+				if err := key.Valid(); err != nil {
+					unauthorizedResponse(err, c)
+					return
+				}
+
+				c.Set("api_key", key)
+				c.Next()
+				return
+			}
+		}
+
+		if !validGlobalToken(config, token) {
+			unauthorizedResponse(fmt.Errorf("Api token is invalid"), c)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// validAdminToken reports whether the request includes the admin token
+func validAdminToken(config *Config, c *gin.Context) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+
+	token := c.Request.Header.Get("X-Admin-Token")
+	if token == "" {
+		token = c.Request.FormValue("admin_token")
+	}
+
+	return secureCompare(hashToken(token), hashToken(config.AdminToken))
+}
+
+// isAdmin reports whether the request was authenticated with the admin token
+func isAdmin(c *gin.Context) bool {
+	return c.GetBool("admin")
+}
+
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := CurrentConfig()
+
+		if config.AdminToken == "" {
+			errorResponse(403, fmt.Errorf("Admin api is disabled"), c)
+			c.Abort()
+			return
+		}
+
+		if !validAdminToken(config, c) {
+			errorResponse(403, fmt.Errorf("Admin token is invalid"), c)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
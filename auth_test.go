@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+func TestRequestSignature(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1446051600\nPOST\n/api/v1/run?namespace=docs\nfilename=test.rb&content=puts 1"))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	sig := requestSignature("secret", "1446051600", "POST", "/api/v1/run?namespace=docs", []byte("filename=test.rb&content=puts 1"))
+	if sig != expected {
+		t.Fatalf("expected %s, got %s", expected, sig)
+	}
+
+	// Every part of the request is covered, including its query and body
+	examples := []struct {
+		name      string
+		secret    string
+		timestamp string
+		method    string
+		uri       string
+		body      string
+	}{
+		{"secret", "other", "1446051600", "POST", "/api/v1/run?namespace=docs", "filename=test.rb&content=puts 1"},
+		{"timestamp", "secret", "1446051601", "POST", "/api/v1/run?namespace=docs", "filename=test.rb&content=puts 1"},
+		{"method", "secret", "1446051600", "PUT", "/api/v1/run?namespace=docs", "filename=test.rb&content=puts 1"},
+		{"path", "secret", "1446051600", "POST", "/api/v1/runs?namespace=docs", "filename=test.rb&content=puts 1"},
+		{"query", "secret", "1446051600", "POST", "/api/v1/run?namespace=other", "filename=test.rb&content=puts 1"},
+		{"body", "secret", "1446051600", "POST", "/api/v1/run?namespace=docs", "filename=test.rb&content=puts 2"},
+		// Fields are separated, so moving the boundary changes the signature
+		{"separator", "secret", "1446051600", "POST", "/api/v1/run?namespace=docs\nfilename=test.rb&content=puts 1", ""},
+	}
+
+	for _, ex := range examples {
+		if requestSignature(ex.secret, ex.timestamp, ex.method, ex.uri, []byte(ex.body)) == sig {
+			t.Errorf("%s: expected signature to change", ex.name)
+		}
+	}
+}
+
+func signedContext(method string, uri string, body string, timestamp string, signature string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, uri, strings.NewReader(body))
+	c.Request.Header.Set("X-Bitrun-Timestamp", timestamp)
+	c.Request.Header.Set("X-Bitrun-Signature", signature)
+	return c
+}
+
+func TestVerifySignature(t *testing.T) {
+	signatureCache = NewSignatureCache()
+
+	config := &Config{
+		HmacSecrets: map[string]string{"backend": "secret"},
+		HmacMaxSkew: 5 * time.Minute,
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sign := func(timestamp string, method string, uri string, body string) string {
+		return "backend:" + requestSignature("secret", timestamp, method, uri, []byte(body))
+	}
+
+	examples := []struct {
+		name      string
+		method    string
+		uri       string
+		body      string
+		timestamp string
+		signature string
+		err       string
+	}{
+		{
+			name:   "valid",
+			method: "POST", uri: "/api/v1/run", body: "content=1",
+			timestamp: now, signature: sign(now, "POST", "/api/v1/run", "content=1"),
+		},
+		{
+			name:   "uppercase hex",
+			method: "POST", uri: "/api/v1/run", body: "content=2",
+			timestamp: now, signature: "backend:" + strings.ToUpper(requestSignature("secret", now, "POST", "/api/v1/run", []byte("content=2"))),
+		},
+		{
+			name:   "tampered body",
+			method: "POST", uri: "/api/v1/run", body: "content=4",
+			timestamp: now, signature: sign(now, "POST", "/api/v1/run", "content=3"),
+			err: "Signature is invalid",
+		},
+		{
+			name:   "tampered query",
+			method: "POST", uri: "/api/v1/run?namespace=other", body: "content=3",
+			timestamp: now, signature: sign(now, "POST", "/api/v1/run?namespace=docs", "content=3"),
+			err: "Signature is invalid",
+		},
+		{
+			name:   "unknown secret",
+			method: "POST", uri: "/api/v1/run", body: "content=3",
+			timestamp: now, signature: "other:" + requestSignature("secret", now, "POST", "/api/v1/run", []byte("content=3")),
+			err: "Signature is invalid",
+		},
+		{
+			name:   "without secret name",
+			method: "POST", uri: "/api/v1/run", body: "content=3",
+			timestamp: now, signature: requestSignature("secret", now, "POST", "/api/v1/run", []byte("content=3")),
+			err: "Signature is invalid",
+		},
+		{
+			name:   "invalid timestamp",
+			method: "POST", uri: "/api/v1/run", body: "content=3",
+			timestamp: "yesterday", signature: sign("yesterday", "POST", "/api/v1/run", "content=3"),
+			err: "Signature timestamp is invalid",
+		},
+		{
+			name:   "expired",
+			method: "POST", uri: "/api/v1/run", body: "content=3",
+			timestamp: "1446051600", signature: sign("1446051600", "POST", "/api/v1/run", "content=3"),
+			err: "Signature is expired",
+		},
+		{
+			name:   "in the future",
+			method: "POST", uri: "/api/v1/run", body: "content=3",
+			timestamp: strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+			signature: sign(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), "POST", "/api/v1/run", "content=3"),
+			err:       "Signature is expired",
+		},
+		{
+			name:   "replayed",
+			method: "POST", uri: "/api/v1/run", body: "content=1",
+			timestamp: now, signature: sign(now, "POST", "/api/v1/run", "content=1"),
+			err: "Signature was already used",
+		},
+	}
+
+	for _, ex := range examples {
+		c := signedContext(ex.method, ex.uri, ex.body, ex.timestamp, ex.signature)
+		err := verifySignature(config, c)
+
+		if ex.err == "" && err != nil {
+			t.Errorf("%s: expected signature to be valid, got %v", ex.name, err)
+		}
+
+		if ex.err != "" && (err == nil || err.Error() != ex.err) {
+			t.Errorf("%s: expected error %q, got %v", ex.name, ex.err, err)
+		}
+	}
+}
+
+func TestVerifySignatureKeepsBody(t *testing.T) {
+	signatureCache = NewSignatureCache()
+
+	config := &Config{
+		HmacSecrets: map[string]string{"backend": "secret"},
+		HmacMaxSkew: 5 * time.Minute,
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := "backend:" + requestSignature("secret", now, "POST", "/api/v1/run", []byte("filename=test.rb"))
+
+	c := signedContext("POST", "/api/v1/run", "filename=test.rb", now, sig)
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := verifySignature(config, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if val := c.Request.FormValue("filename"); val != "test.rb" {
+		t.Errorf("expected body to be readable after verification, got %q", val)
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	cache := NewSignatureCache()
+
+	if !cache.Add("a", time.Now().Add(time.Minute)) {
+		t.Errorf("expected new signature to be accepted")
+	}
+
+	if cache.Add("a", time.Now().Add(time.Minute)) {
+		t.Errorf("expected used signature to be rejected")
+	}
+
+	if !cache.Add("b", time.Now().Add(-time.Second)) || !cache.Add("b", time.Now().Add(time.Minute)) {
+		t.Errorf("expected expired signature to be forgotten")
+	}
+}
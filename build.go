@@ -0,0 +1,438 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	gin "github.com/gin-gonic/gin"
+)
+
+// Default command to install packages on top of a debian based image
+const defaultInstallCommand = "apt-get update && apt-get install -y --no-install-recommends %s && rm -rf /var/lib/apt/lists/*"
+
+// Number of finished builds kept for the admin api
+const maxBuildHistory = 50
+
+// Maximum size of a build log, the rest is dropped
+const maxBuildLog = 1 << 20
+
+// Image label with the hash of the definition the image was built from
+const buildHashLabel = "bitrun.build_hash"
+
+var PackageRegexp = regexp.MustCompile(`\A[a-zA-Z\d\.\-\+\_\:\=]+\z`)
+
+// BuildSpec describes how to build a language image, either from an inline
+// Dockerfile or as a list of packages installed on top of a base image
+type BuildSpec struct {
+	Dockerfile string   `json:"dockerfile,omitempty"`
+	Base       string   `json:"base,omitempty"`
+	Packages   []string `json:"packages,omitempty"`
+	// Package install command, %s is replaced with the list of packages
+	Install string `json:"install,omitempty"`
+}
+
+// ImageBuild is a build of a language image
+type ImageBuild struct {
+	Id         string     `json:"id"`
+	Image      string     `json:"image"`
+	Hash       string     `json:"hash"`
+	Status     string     `json:"status"`
+	Digest     string     `json:"digest,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	log        *buildLog
+}
+
+// buildLog collects build output, it is read while the build is running
+type buildLog struct {
+	buff bytes.Buffer
+	sync.Mutex
+}
+
+// Builder builds language images one at a time
+type Builder struct {
+	Client *docker.Client
+	Builds []*ImageBuild
+	// Held for the duration of a build
+	building sync.Mutex
+	sync.Mutex
+}
+
+var imageBuilder *Builder
+
+func (spec *BuildSpec) Validate() error {
+	if spec == nil {
+		return nil
+	}
+
+	if spec.Dockerfile == "" && spec.Base == "" {
+		return fmt.Errorf("Dockerfile or base image is required")
+	}
+
+	if spec.Dockerfile != "" && (spec.Base != "" || len(spec.Packages) > 0) {
+		return fmt.Errorf("Dockerfile could not be combined with base image and packages")
+	}
+
+	for _, pkg := range spec.Packages {
+		if !PackageRegexp.MatchString(pkg) {
+			return fmt.Errorf("Invalid package: %s", pkg)
+		}
+	}
+
+	return nil
+}
+
+// DockerfileContent returns the Dockerfile to build the image with
+func (spec *BuildSpec) DockerfileContent() string {
+	if spec.Dockerfile != "" {
+		return spec.Dockerfile
+	}
+
+	lines := []string{"FROM " + spec.Base}
+
+	if len(spec.Packages) > 0 {
+		install := spec.Install
+		if install == "" {
+			install = defaultInstallCommand
+		}
+
+		lines = append(lines, "RUN "+fmt.Sprintf(install, strings.Join(spec.Packages, " ")))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Hash identifies the image definition, images are rebuilt when it changes
+func (spec *BuildSpec) Hash() string {
+	return sha1Sum(spec.DockerfileContent())
+}
+
+func (log *buildLog) Write(data []byte) (int, error) {
+	log.Lock()
+	defer log.Unlock()
+
+	if remaining := maxBuildLog - log.buff.Len(); remaining > 0 {
+		if len(data) > remaining {
+			log.buff.Write(data[:remaining])
+		} else {
+			log.buff.Write(data)
+		}
+	}
+
+	return len(data), nil
+}
+
+func (log *buildLog) String() string {
+	log.Lock()
+	defer log.Unlock()
+
+	return log.buff.String()
+}
+
+// languageBuilds returns build specs of language images by image name
+func languageBuilds(langs map[string]Language) map[string]*BuildSpec {
+	specs := map[string]*BuildSpec{}
+
+	for _, lang := range langs {
+		if lang.Build != nil {
+			specs[lang.Image] = lang.Build
+		}
+
+		for _, v := range lang.Versions {
+			if v.Build != nil {
+				specs[v.Image] = v.Build
+			}
+		}
+	}
+
+	return specs
+}
+
+func NewBuilder(client *docker.Client) *Builder {
+	return &Builder{
+		Client: client,
+		Builds: []*ImageBuild{},
+	}
+}
+
+// NeedsBuild reports whether the image is missing or was built from another
+// definition
+func (builder *Builder) NeedsBuild(image string, spec *BuildSpec) bool {
+	ts := time.Now()
+	info, err := builder.Client.InspectImage(image)
+	observeDocker("inspect_image", ts, err)
+
+	if err != nil || info.Config == nil {
+		return true
+	}
+
+	return info.Config.Labels[buildHashLabel] != spec.Hash()
+}
+
+// BuildAll builds images of the languages that are missing or outdated, all
+// of them when force is set. Builds run in order of image names, a failed
+// build is recorded in the image tracker and does not stop the others.
+func (builder *Builder) BuildAll(langs map[string]Language, force bool) {
+	specs := languageBuilds(langs)
+
+	images := []string{}
+	for image := range specs {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	for _, image := range images {
+		if !force && !builder.NeedsBuild(image, specs[image]) {
+			logger.Debug("image is up to date", "image", image)
+			continue
+		}
+
+		build := builder.Start(image, specs[image])
+		builder.Run(build, specs[image])
+	}
+}
+
+// Start registers a pending build of the image
+func (builder *Builder) Start(image string, spec *BuildSpec) *ImageBuild {
+	id, _ := randomHex(8)
+
+	build := &ImageBuild{
+		Id:        id,
+		Image:     image,
+		Hash:      spec.Hash(),
+		Status:    "pending",
+		CreatedAt: time.Now().UTC(),
+		log:       &buildLog{},
+	}
+
+	builder.Lock()
+	defer builder.Unlock()
+
+	builder.Builds = append(builder.Builds, build)
+	if len(builder.Builds) > maxBuildHistory {
+		builder.Builds = append([]*ImageBuild{}, builder.Builds[len(builder.Builds)-maxBuildHistory:]...)
+	}
+
+	return build
+}
+
+func (builder *Builder) setStatus(build *ImageBuild, status string, err error) {
+	builder.Lock()
+	defer builder.Unlock()
+
+	build.Status = status
+
+	if status == "success" || status == "failed" {
+		now := time.Now().UTC()
+		build.FinishedAt = &now
+	}
+
+	if err != nil {
+		build.Error = err.Error()
+	}
+}
+
+// Run builds and tags the image, then records its digest and image state. An
+// image left from a previous build keeps serving runs when the build fails.
+func (builder *Builder) Run(build *ImageBuild, spec *BuildSpec) error {
+	builder.building.Lock()
+	defer builder.building.Unlock()
+
+	builder.setStatus(build, "building", nil)
+	logger.Info("building image", "image", build.Image, "build_id", build.Id)
+
+	// Image left from a previous build keeps serving runs meanwhile
+	if entry := imageTracker.Get(build.Image); entry == nil || entry.State != "ready" {
+		imageTracker.Set(build.Image, "build", "building", nil)
+	}
+
+	err := builder.build(build, spec)
+	if err != nil {
+		builder.setStatus(build, "failed", err)
+		logger.Error("image build failed", "image", build.Image, "build_id", build.Id, "error", err)
+
+		err = fmt.Errorf("Build of %s failed: %s", build.Image, err)
+
+		if _, inspectErr := inspectImage(builder.Client, build.Image); inspectErr == nil {
+			imageTracker.Set(build.Image, "build", "ready", err)
+		} else {
+			imageTracker.Set(build.Image, "build", "failed", err)
+		}
+
+		return err
+	}
+
+	builder.setStatus(build, "success", nil)
+	imageTracker.Set(build.Image, "build", "ready", nil)
+	logger.Info("image built", "image", build.Image, "build_id", build.Id, "digest", build.Digest)
+
+	return nil
+}
+
+func (builder *Builder) build(build *ImageBuild, spec *BuildSpec) error {
+	dockerfile := spec.DockerfileContent() + fmt.Sprintf("LABEL %s=%s\n", buildHashLabel, build.Hash)
+
+	input := bytes.NewBuffer(nil)
+	archive := tar.NewWriter(input)
+
+	header := &tar.Header{
+		Name:    "Dockerfile",
+		Mode:    0644,
+		Size:    int64(len(dockerfile)),
+		ModTime: time.Now(),
+	}
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if _, err := archive.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CurrentConfig().BuildTimeout)
+	defer cancel()
+
+	ts := time.Now()
+	err := builder.Client.BuildImage(docker.BuildImageOptions{
+		Name:           build.Image,
+		InputStream:    input,
+		OutputStream:   build.log,
+		RmTmpContainer: true,
+		Context:        ctx,
+	})
+	observeDocker("build_image", ts, err)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Build timed out after %s", CurrentConfig().BuildTimeout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	info, err := inspectImage(builder.Client, build.Image)
+	if err != nil {
+		return err
+	}
+
+	builder.Lock()
+	build.Digest = info.ID
+	builder.Unlock()
+
+	return nil
+}
+
+// List returns builds, newest first
+func (builder *Builder) List() []ImageBuild {
+	builder.Lock()
+	defer builder.Unlock()
+
+	builds := []ImageBuild{}
+	for i := len(builder.Builds) - 1; i >= 0; i-- {
+		builds = append(builds, *builder.Builds[i])
+	}
+
+	return builds
+}
+
+func (builder *Builder) Get(id string) *ImageBuild {
+	builder.Lock()
+	defer builder.Unlock()
+
+	for _, build := range builder.Builds {
+		if build.Id == id {
+			return build
+		}
+	}
+
+	return nil
+}
+
+func HandleListBuilds(c *gin.Context) {
+	c.JSON(200, imageBuilder.List())
+}
+
+// HandleCreateBuild starts builds of language images in background. Builds
+// are limited to the image parameter when given, force rebuilds up to date
+// images.
+func HandleCreateBuild(c *gin.Context) {
+	specs := languageBuilds(GetLanguages())
+
+	image := strings.TrimSpace(c.Request.FormValue("image"))
+	force := c.Request.FormValue("force") == "1"
+
+	if image != "" {
+		spec, ok := specs[image]
+		if !ok {
+			errorResponse(404, fmt.Errorf("Image has no build definition: %s", image), c)
+			return
+		}
+
+		specs = map[string]*BuildSpec{image: spec}
+	}
+
+	images := []string{}
+	for image := range specs {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	builds := []ImageBuild{}
+	started := []*ImageBuild{}
+
+	for _, image := range images {
+		if !force && !imageBuilder.NeedsBuild(image, specs[image]) {
+			continue
+		}
+
+		build := imageBuilder.Start(image, specs[image])
+		started = append(started, build)
+		builds = append(builds, *build)
+	}
+
+	go func() {
+		for _, build := range started {
+			imageBuilder.Run(build, specs[build.Image])
+		}
+	}()
+
+	c.JSON(202, builds)
+}
+
+func HandleBuild(c *gin.Context) {
+	build := imageBuilder.Get(c.Param("id"))
+	if build == nil {
+		errorResponse(404, fmt.Errorf("Build does not exist"), c)
+		return
+	}
+
+	imageBuilder.Lock()
+	result := *build
+	imageBuilder.Unlock()
+
+	c.JSON(200, result)
+}
+
+func HandleBuildLog(c *gin.Context) {
+	build := imageBuilder.Get(c.Param("id"))
+	if build == nil {
+		errorResponse(404, fmt.Errorf("Build does not exist"), c)
+		return
+	}
+
+	c.Data(200, "text/plain; charset=utf-8", []byte(build.log.String()))
+}
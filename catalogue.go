@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Format version of the /config response, bumped on incompatible changes
+const catalogueVersion = 2
+
+// Catalogue describes languages and limits available to the caller
+type Catalogue struct {
+	Version   int                  `json:"version"`
+	Languages []*CatalogueLanguage `json:"languages"`
+	Limits    CatalogueLimits      `json:"limits"`
+}
+
+type CatalogueLanguage struct {
+	Id          string              `json:"id"`
+	DisplayName string              `json:"display_name"`
+	Extensions  []string            `json:"extensions"`
+	Filenames   []string            `json:"filenames,omitempty"`
+	Format      string              `json:"format"`
+	Command     string              `json:"command"`
+	Image       string              `json:"image"`
+	Warm        bool                `json:"warm"`
+	Allowed     bool                `json:"allowed"`
+	Versions    []*CatalogueVersion `json:"versions"`
+	Example     *CatalogueExample   `json:"example,omitempty"`
+}
+
+type CatalogueVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Image   string `json:"image"`
+	Command string `json:"command"`
+	Default bool   `json:"default"`
+	Warm    bool   `json:"warm"`
+	// Dependency manifest filename, empty when dependencies are not supported
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// CatalogueExample is a hello world snippet ready to be sent to /run
+type CatalogueExample struct {
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+// CatalogueLimits are limits effective for the caller, zero means unlimited
+type CatalogueLimits struct {
+	Timeout      float64    `json:"timeout"`
+	MemoryLimit  int64      `json:"memory_limit"`
+	Quota        int        `json:"quota"`
+	Burst        int        `json:"burst"`
+	Window       float64    `json:"window"`
+	Concurrency  int        `json:"concurrency"`
+	Sessions     int        `json:"sessions"`
+	DailyQuota   UsageQuota `json:"daily_quota"`
+	MonthlyQuota UsageQuota `json:"monthly_quota"`
+	Languages    []string   `json:"languages,omitempty"`
+}
+
+// NewCatalogue builds the catalogue for the request. Extensions sharing a
+// language name are listed under a single language.
+func NewCatalogue(c *gin.Context, config *Config) *Catalogue {
+	key := getApiKey(c)
+	langs := GetLanguages()
+
+	catalogue := &Catalogue{
+		Version:   catalogueVersion,
+		Languages: []*CatalogueLanguage{},
+		Limits:    catalogueLimits(c, config, key),
+	}
+
+	index := map[string]*CatalogueLanguage{}
+
+	for _, ext := range sortedExtensions(langs) {
+		lang := langs[ext]
+		allowed := key == nil || key.LanguageAllowed(lang.Name)
+
+		if entry, ok := index[lang.Name]; ok {
+			entry.Extensions = append(entry.Extensions, ext)
+			entry.Filenames = append(entry.Filenames, lang.Filenames...)
+			entry.Allowed = entry.Allowed || allowed
+			continue
+		}
+
+		entry := &CatalogueLanguage{
+			Id:          lang.Name,
+			DisplayName: lang.DisplayName,
+			Extensions:  []string{ext},
+			Filenames:   lang.Filenames,
+			Format:      lang.Format,
+			Command:     lang.Command,
+			Image:       lang.Image,
+			Warm:        getPool(lang.Image) != nil,
+			Allowed:     allowed,
+			Versions:    []*CatalogueVersion{},
+		}
+
+		versions := lang.Versions
+		if len(versions) == 0 {
+			v, _ := lang.Version("")
+			versions = []*LanguageVersion{v}
+		}
+
+		for _, v := range versions {
+			version := &CatalogueVersion{
+				Name:    v.Name,
+				Version: v.Version,
+				Image:   v.Image,
+				Command: v.Command,
+				Default: v.Default,
+				Warm:    getPool(v.Image) != nil,
+			}
+
+			if v.Dependencies != nil && depsCache != nil {
+				version.Manifest = v.Dependencies.Manifest
+			}
+
+			entry.Versions = append(entry.Versions, version)
+		}
+
+		if lang.Example != "" {
+			entry.Example = &CatalogueExample{
+				Filename: "main" + ext,
+				Content:  lang.Example,
+			}
+		}
+
+		index[lang.Name] = entry
+		catalogue.Languages = append(catalogue.Languages, entry)
+	}
+
+	return catalogue
+}
+
+func catalogueLimits(c *gin.Context, config *Config, key *ApiKey) CatalogueLimits {
+	limits := CatalogueLimits{
+		Timeout:     config.RunDuration.Seconds(),
+		MemoryLimit: config.MemoryLimit,
+	}
+
+	if config.Sessions {
+		limits.Sessions = config.SessionsPerKey
+	}
+
+	quotas := usageQuotas(config, key)
+	limits.DailyQuota = quotas[0]
+	limits.MonthlyQuota = quotas[1]
+
+	if key != nil {
+		if maxDuration := time.Duration(key.MaxDuration) * time.Second; maxDuration > 0 && maxDuration < config.RunDuration {
+			limits.Timeout = maxDuration.Seconds()
+		}
+
+		if key.MaxMemory > 0 && (limits.MemoryLimit == 0 || key.MaxMemory < limits.MemoryLimit) {
+			limits.MemoryLimit = key.MaxMemory
+		}
+
+		for _, lang := range key.Languages {
+			limits.Languages = append(limits.Languages, LanguageId(lang))
+		}
+
+		if config.Sessions && key.Sessions > 0 {
+			limits.Sessions = key.Sessions
+		}
+	}
+
+	ip := clientIP(c)
+	if apiThrottler != nil && (key != nil || !apiThrottler.Whitelisted(ip)) {
+		namespace := normalizeString(c.Query("namespace"))
+		if key != nil && key.Namespace != "" {
+			namespace = key.Namespace
+		}
+
+		_, throttle := apiThrottler.Subject(ip, namespace, key)
+
+		limits.Quota = throttle.Quota
+		limits.Burst = throttle.Burst
+		limits.Window = throttle.Window.Seconds()
+		limits.Concurrency = throttle.Concurrency
+	}
+
+	return limits
+}
+
+// etagMatch reports whether If-None-Match header includes the etag
+func etagMatch(header string, etag string) bool {
+	for _, val := range strings.Split(header, ",") {
+		val = strings.TrimPrefix(strings.TrimSpace(val), "W/")
+		if val == etag || val == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func HandleConfig(c *gin.Context) {
+	config, exists := c.Get("config")
+	if !exists {
+		errorResponse(400, fmt.Errorf("Cant get config"), c)
+		return
+	}
+
+	data, err := json.Marshal(NewCatalogue(c, config.(*Config)))
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	// Catalogue depends on the caller key and changes on reload
+	etag := fmt.Sprintf(`"%s"`, sha1Sum(string(data)))
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Vary", "Authorization")
+
+	if etagMatch(c.Request.Header.Get("If-None-Match"), etag) {
+		c.Status(304)
+		return
+	}
+
+	c.Data(200, "application/json; charset=utf-8", data)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// IPMatcher matches addresses against a list of IPs and CIDR ranges
+type IPMatcher struct {
+	nets []*net.IPNet
+}
+
+func NewIPMatcher(list []string) (*IPMatcher, error) {
+	matcher := &IPMatcher{nets: []*net.IPNet{}}
+
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address: %s", item)
+			}
+
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR range: %s", item)
+		}
+
+		matcher.nets = append(matcher.nets, ipnet)
+	}
+
+	return matcher, nil
+}
+
+func (m *IPMatcher) Contains(addr string) bool {
+	if m == nil {
+		return false
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range m.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHost strips port and brackets from an address and normalizes the IP
+func parseHost(addr string) string {
+	addr = strings.Trim(strings.TrimSpace(addr), `"`)
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// forwardedFor returns "for" values of the Forwarded header (RFC 7239)
+func forwardedFor(header string) []string {
+	result := []string{}
+
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			chunks := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+
+			if len(chunks) == 2 && strings.EqualFold(chunks[0], "for") {
+				result = append(result, chunks[1])
+			}
+		}
+	}
+
+	return result
+}
+
+// resolveClientIP walks the proxy chain from the nearest hop and returns the
+// first address that is not a trusted proxy
+func resolveClientIP(remoteAddr string, header func(string) string, trusted *IPMatcher) string {
+	ip := parseHost(remoteAddr)
+
+	if ip == "" || !trusted.Contains(ip) {
+		return ip
+	}
+
+	var chain []string
+
+	if val := header("Forwarded"); val != "" {
+		chain = forwardedFor(val)
+	} else if val := header("X-Forwarded-For"); val != "" {
+		chain = strings.Split(val, ",")
+	} else if val := header("X-Real-Ip"); val != "" {
+		chain = []string{val}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseHost(chain[i])
+		if hop == "" {
+			break
+		}
+
+		ip = hop
+		if !trusted.Contains(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func clientIP(c *gin.Context) string {
+	if ip, exists := c.Get("client_ip"); exists {
+		return ip.(string)
+	}
+
+	var trusted *IPMatcher
+	if config := CurrentConfig(); config != nil {
+		trusted = config.trustedProxies
+	}
+
+	ip := resolveClientIP(c.Request.RemoteAddr, c.Request.Header.Get, trusted)
+	c.Set("client_ip", ip)
+
+	return ip
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := NewIPMatcher([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	examples := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		trusted *IPMatcher
+		ip      string
+	}{
+		{
+			name:   "direct connection",
+			remote: "1.2.3.4:5000",
+			ip:     "1.2.3.4",
+		},
+		{
+			name:    "untrusted peer headers are ignored",
+			remote:  "1.2.3.4:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			trusted: trusted,
+			ip:      "1.2.3.4",
+		},
+		{
+			name:    "no trusted proxies",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			ip:      "10.0.0.1",
+		},
+		{
+			name:    "trusted proxy",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "chain of trusted proxies",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8, 192.168.1.1, 10.2.3.4"},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "spoofed leftmost entry",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "127.0.0.1, 5.6.7.8"},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "untrusted hop in the middle",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "10.9.9.9, 5.6.7.8, 10.2.3.4"},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "single ip outside of trusted range",
+			remote:  "192.168.1.2:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			trusted: trusted,
+			ip:      "192.168.1.2",
+		},
+		{
+			name:    "all hops trusted",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"},
+			trusted: trusted,
+			ip:      "10.1.1.1",
+		},
+		{
+			name:   "forwarded header",
+			remote: "10.0.0.1:5000",
+			headers: map[string]string{
+				"Forwarded": `for=5.6.7.8;proto=https, for="10.2.3.4:8080"`,
+			},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:   "forwarded header takes precedence",
+			remote: "10.0.0.1:5000",
+			headers: map[string]string{
+				"Forwarded":       "for=5.6.7.8",
+				"X-Forwarded-For": "9.9.9.9",
+			},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "forwarded ipv6",
+			remote:  "[fd00::1]:5000",
+			headers: map[string]string{"Forwarded": `For="[2001:db8::1]:4711"`},
+			trusted: trusted,
+			ip:      "2001:db8::1",
+		},
+		{
+			name:    "x-real-ip",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Real-Ip": "5.6.7.8"},
+			trusted: trusted,
+			ip:      "5.6.7.8",
+		},
+		{
+			name:    "malformed hop stops the walk",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "5.6.7.8, garbage, 10.2.3.4"},
+			trusted: trusted,
+			ip:      "10.2.3.4",
+		},
+		{
+			name:    "malformed header",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "unknown"},
+			trusted: trusted,
+			ip:      "10.0.0.1",
+		},
+		{
+			name:    "obfuscated forwarded identifier",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"Forwarded": "for=_hidden"},
+			trusted: trusted,
+			ip:      "10.0.0.1",
+		},
+		{
+			name:    "forwarded header without for",
+			remote:  "10.0.0.1:5000",
+			headers: map[string]string{"Forwarded": "proto=https;by=10.0.0.1"},
+			trusted: trusted,
+			ip:      "10.0.0.1",
+		},
+		{
+			name:   "malformed remote address",
+			remote: "not an address",
+			ip:     "",
+		},
+	}
+
+	for _, ex := range examples {
+		header := http.Header{}
+		for name, val := range ex.headers {
+			header.Set(name, val)
+		}
+
+		ip := resolveClientIP(ex.remote, header.Get, ex.trusted)
+		if ip != ex.ip {
+			t.Errorf("%s: expected %q, got %q", ex.name, ex.ip, ip)
+		}
+	}
+}
+
+func TestNewIPMatcher(t *testing.T) {
+	examples := []struct {
+		list  []string
+		valid bool
+	}{
+		{[]string{"10.0.0.1", "10.0.0.0/8", "::1", "fd00::/8"}, true},
+		{[]string{" 10.0.0.1 "}, true},
+		{[]string{"10.0.0.256"}, false},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"localhost"}, false},
+	}
+
+	for _, ex := range examples {
+		_, err := NewIPMatcher(ex.list)
+		if (err == nil) != ex.valid {
+			t.Errorf("%v: expected valid %v, got error %v", ex.list, ex.valid, err)
+		}
+	}
+}
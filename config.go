@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -14,20 +16,106 @@ type PoolConfig struct {
 }
 
 type Config struct {
-	Listen              string        `json:"listen"`
-	DockerHost          string        `json:"docker_host"`
-	LanguagesPath       string        `json:"languages_path"`
-	SharedPath          string        `json:"shared_path"`
-	RunDuration         time.Duration `json:"run_duration"`
-	ThrottleQuota       int           `json:"throttle_quota"`
-	ThrottleConcurrency int           `json:"throttle_concurrency"`
-	ThrottleWhitelist   []string      `json:"throttle_whitelist"`
-	NetworkDisabled     bool          `json:"network_disabled"`
-	MemoryLimit         int64         `json:"memory_limit"`
-	Pools               []PoolConfig  `json:"pools"`
-	ApiToken            string        `json:"api_token"`
-	FetchImages         bool          `json:"fetch_images"`
-	Namespaces          bool          `json:"namespaces"`
+	Listen              string            `json:"listen"`
+	DockerHost          string            `json:"docker_host"`
+	LanguagesPath       string            `json:"languages_path"`
+	SharedPath          string            `json:"shared_path"`
+	RunDuration         time.Duration     `json:"run_duration"`
+	ThrottleQuota       int               `json:"throttle_quota"`
+	ThrottleConcurrency int               `json:"throttle_concurrency"`
+	ThrottleWhitelist   []string          `json:"throttle_whitelist"`
+	ThrottleBurst       int               `json:"throttle_burst"`
+	ThrottleWindow      time.Duration     `json:"throttle_window"`
+	ThrottleRules       []ThrottleRule    `json:"throttle_rules"`
+	NetworkDisabled     bool              `json:"network_disabled"`
+	MemoryLimit         int64             `json:"memory_limit"`
+	Pools               []PoolConfig      `json:"pools"`
+	ApiToken            string            `json:"api_token"`
+	FetchImages         bool              `json:"fetch_images"`
+	PullPolicy          string            `json:"pull_policy"`
+	PullPolicies        map[string]string `json:"pull_policies"`
+	PullRefreshInterval time.Duration     `json:"pull_refresh_interval"`
+	BuildTimeout        time.Duration     `json:"build_timeout"`
+	RegistryAuthPath    string            `json:"registry_auth_path"`
+	Namespaces          bool              `json:"namespaces"`
+	AdminToken          string            `json:"admin_token"`
+	ShutdownTimeout     time.Duration     `json:"shutdown_timeout"`
+	KeepPools           bool              `json:"keep_pools"`
+	ReadyPoolFill       int               `json:"ready_pool_fill"`
+	LogFormat           string            `json:"log_format"`
+	LogLevel            string            `json:"log_level"`
+	TraceExporter       string            `json:"trace_exporter"`
+	TraceEndpoint       string            `json:"trace_endpoint"`
+	TraceFile           string            `json:"trace_file"`
+	KeysPath            string            `json:"keys_path"`
+	ApiTokenHash        string            `json:"api_token_hash"`
+	HmacSecrets         map[string]string `json:"hmac_secrets"`
+	HmacMaxSkew         time.Duration     `json:"hmac_max_skew"`
+	JwtSecret           string            `json:"jwt_secret"`
+	JwtPublicKey        string            `json:"jwt_public_key"`
+	JwksPath            string            `json:"jwks_path"`
+	JwtIssuer           string            `json:"jwt_issuer"`
+	JwtAudience         string            `json:"jwt_audience"`
+	JwtMaxTTL           time.Duration     `json:"jwt_max_ttl"`
+	TrustedProxies      []string          `json:"trusted_proxies"`
+	ThrottleBackend     string            `json:"throttle_backend"`
+	RedisAddress        string            `json:"redis_address"`
+	RedisPassword       string            `json:"redis_password"`
+	RedisDB             int               `json:"redis_db"`
+	RedisPrefix         string            `json:"redis_prefix"`
+	UsageDaily          UsageQuota        `json:"usage_daily"`
+	UsageMonthly        UsageQuota        `json:"usage_monthly"`
+	UsagePath           string            `json:"usage_path"`
+	NamespacesPath      string            `json:"namespaces_path"`
+	NamespaceQuota      int64             `json:"namespace_quota"`
+	NamespaceTTL        time.Duration     `json:"namespace_ttl"`
+	Sessions            bool              `json:"sessions"`
+	SessionsPerKey      int               `json:"sessions_per_key"`
+	MaxSessions         int               `json:"max_sessions"`
+	SessionIdleTimeout  time.Duration     `json:"session_idle_timeout"`
+	SessionMaxLifetime  time.Duration     `json:"session_max_lifetime"`
+	ArtifactsPath       string            `json:"artifacts_path"`
+	ArtifactTTL         time.Duration     `json:"artifact_ttl"`
+	ArtifactMaxFiles    int               `json:"artifact_max_files"`
+	ArtifactMaxBytes    int64             `json:"artifact_max_bytes"`
+	HistoryBackend      string            `json:"history_backend"`
+	HistoryPath         string            `json:"history_path"`
+	HistoryMaxAge       time.Duration     `json:"history_max_age"`
+	HistoryMaxRecords   int               `json:"history_max_records"`
+	HistoryOutputBytes  int               `json:"history_output_bytes"`
+	ImageAllowlist      []string          `json:"image_allowlist"`
+	Deps                bool              `json:"deps"`
+	DepsPath            string            `json:"deps_path"`
+	DepsTTL             time.Duration     `json:"deps_ttl"`
+	DepsTimeout         time.Duration     `json:"deps_timeout"`
+	DepsMemoryLimit     int64             `json:"deps_memory_limit"`
+	DepsNetwork         string            `json:"deps_network"`
+	DepsEnv             []string          `json:"deps_env"`
+	SnippetsPath        string            `json:"snippets_path"`
+	SnippetTTL          time.Duration     `json:"snippet_ttl"`
+	SnippetMaxBytes     int64             `json:"snippet_max_bytes"`
+	SnippetOutputBytes  int               `json:"snippet_output_bytes"`
+
+	trustedProxies *IPMatcher
+}
+
+var (
+	currentConfig      *Config
+	currentConfigMutex sync.RWMutex
+)
+
+func CurrentConfig() *Config {
+	currentConfigMutex.RLock()
+	defer currentConfigMutex.RUnlock()
+
+	return currentConfig
+}
+
+func SetCurrentConfig(config *Config) {
+	currentConfigMutex.Lock()
+	defer currentConfigMutex.Unlock()
+
+	currentConfig = config
 }
 
 func NewConfig() *Config {
@@ -42,12 +130,45 @@ func NewConfig() *Config {
 	cfg.ThrottleQuota = 5
 	cfg.ThrottleConcurrency = 1
 	cfg.ThrottleWhitelist = []string{}
+	cfg.ThrottleWindow = time.Second * 5
 	cfg.NetworkDisabled = false
 	cfg.MemoryLimit = 67108864
 	cfg.Pools = []PoolConfig{}
 	cfg.FetchImages = false
+	cfg.PullPolicies = map[string]string{}
+	cfg.PullRefreshInterval = time.Hour * 24
+	cfg.BuildTimeout = time.Minute * 30
 	cfg.Namespaces = false
+	cfg.NamespaceQuota = 10485760
+	cfg.NamespaceTTL = time.Hour * 24 * 7
+	cfg.Sessions = false
+	cfg.SessionsPerKey = 2
+	cfg.MaxSessions = 20
+	cfg.SessionIdleTimeout = time.Minute * 5
+	cfg.SessionMaxLifetime = time.Hour
+	cfg.ArtifactTTL = time.Hour
+	cfg.ArtifactMaxFiles = 10
+	cfg.ArtifactMaxBytes = 1048576
+	cfg.HistoryBackend = "file"
+	cfg.HistoryMaxAge = time.Hour * 24 * 7
+	cfg.HistoryMaxRecords = 10000
+	cfg.HistoryOutputBytes = 4096
+	cfg.DepsTTL = time.Hour * 24 * 7
+	cfg.DepsTimeout = time.Minute * 2
+	cfg.DepsMemoryLimit = 268435456
+	cfg.SnippetTTL = time.Hour * 24 * 30
+	cfg.SnippetMaxBytes = 65536
+	cfg.SnippetOutputBytes = 65536
 	cfg.LanguagesPath = "./languages.json"
+	cfg.ShutdownTimeout = time.Second * 30
+	cfg.KeepPools = false
+	cfg.ReadyPoolFill = 50
+	cfg.LogFormat = "logfmt"
+	cfg.LogLevel = "info"
+	cfg.HmacMaxSkew = time.Minute * 5
+	cfg.JwtMaxTTL = time.Hour
+	cfg.ThrottleBackend = "memory"
+	cfg.RedisPrefix = "bitrun:"
 
 	return &cfg
 }
@@ -58,18 +179,272 @@ func NewConfigFromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
-	config := Config{}
+	// Defaults set before decoding are kept only for missing keys, so an
+	// explicit 0 disables the pool fill check
+	config := Config{ReadyPoolFill: 50}
 
 	err = json.Unmarshal(data, &config)
 
 	if err == nil {
 		config.SharedPath = expandPath(config.SharedPath)
 		config.RunDuration = config.RunDuration * time.Second
+		config.ShutdownTimeout = config.ShutdownTimeout * time.Second
+		config.ThrottleWindow = config.ThrottleWindow * time.Second
+		config.HmacMaxSkew = config.HmacMaxSkew * time.Second
+		config.JwtMaxTTL = config.JwtMaxTTL * time.Second
+		config.NamespaceTTL = config.NamespaceTTL * time.Second
+		config.SessionIdleTimeout = config.SessionIdleTimeout * time.Second
+		config.SessionMaxLifetime = config.SessionMaxLifetime * time.Second
+		config.ArtifactTTL = config.ArtifactTTL * time.Second
+		config.ArtifactsPath = expandPath(config.ArtifactsPath)
+		config.HistoryMaxAge = config.HistoryMaxAge * time.Second
+		config.DepsTTL = config.DepsTTL * time.Second
+		config.DepsTimeout = config.DepsTimeout * time.Second
+		config.DepsPath = expandPath(config.DepsPath)
+		config.SnippetTTL = config.SnippetTTL * time.Second
+		config.SnippetsPath = expandPath(config.SnippetsPath)
+		config.NamespacesPath = expandPath(config.NamespacesPath)
+		config.PullRefreshInterval = config.PullRefreshInterval * time.Second
+		config.BuildTimeout = config.BuildTimeout * time.Second
+		config.RegistryAuthPath = expandPath(config.RegistryAuthPath)
+
+		if config.ThrottleWindow == 0 {
+			config.ThrottleWindow = time.Second * 5
+		}
+
+		if config.ShutdownTimeout == 0 {
+			config.ShutdownTimeout = time.Second * 30
+		}
+
+		if config.HmacMaxSkew == 0 {
+			config.HmacMaxSkew = time.Minute * 5
+		}
+
+		if config.ThrottleBackend == "" {
+			config.ThrottleBackend = "memory"
+		}
+
+		if config.RedisPrefix == "" {
+			config.RedisPrefix = "bitrun:"
+		}
+
+		if config.NamespaceQuota == 0 {
+			config.NamespaceQuota = 10485760
+		}
+
+		if config.NamespaceTTL == 0 {
+			config.NamespaceTTL = time.Hour * 24 * 7
+		}
+
+		if config.SessionsPerKey == 0 {
+			config.SessionsPerKey = 2
+		}
+
+		if config.SessionIdleTimeout == 0 {
+			config.SessionIdleTimeout = time.Minute * 5
+		}
+
+		if config.SessionMaxLifetime == 0 {
+			config.SessionMaxLifetime = time.Hour
+		}
+
+		if config.ArtifactTTL == 0 {
+			config.ArtifactTTL = time.Hour
+		}
+
+		if config.ArtifactMaxFiles == 0 {
+			config.ArtifactMaxFiles = 10
+		}
+
+		if config.ArtifactMaxBytes == 0 {
+			config.ArtifactMaxBytes = 1048576
+		}
+
+		if config.HistoryBackend == "" {
+			config.HistoryBackend = "file"
+		}
+
+		if config.HistoryMaxAge == 0 {
+			config.HistoryMaxAge = time.Hour * 24 * 7
+		}
+
+		if config.HistoryMaxRecords == 0 {
+			config.HistoryMaxRecords = 10000
+		}
+
+		if config.HistoryOutputBytes == 0 {
+			config.HistoryOutputBytes = 4096
+		}
+
+		if config.DepsTTL == 0 {
+			config.DepsTTL = time.Hour * 24 * 7
+		}
+
+		if config.DepsTimeout == 0 {
+			config.DepsTimeout = time.Minute * 2
+		}
+
+		if config.DepsMemoryLimit == 0 {
+			config.DepsMemoryLimit = 268435456
+		}
+
+		if config.SnippetTTL == 0 {
+			config.SnippetTTL = time.Hour * 24 * 30
+		}
+
+		if config.SnippetMaxBytes == 0 {
+			config.SnippetMaxBytes = 65536
+		}
+
+		if config.SnippetOutputBytes == 0 {
+			config.SnippetOutputBytes = 65536
+		}
+
+		if config.PullRefreshInterval == 0 {
+			config.PullRefreshInterval = time.Hour * 24
+		}
+
+		if config.BuildTimeout == 0 {
+			config.BuildTimeout = time.Minute * 30
+		}
+
+		if config.JwtMaxTTL == 0 {
+			config.JwtMaxTTL = time.Hour
+		}
+
+		if config.LogFormat == "" {
+			config.LogFormat = "logfmt"
+		}
+
+		if config.LogLevel == "" {
+			config.LogLevel = "info"
+		}
 
 		if config.Listen == "" {
 			config.Listen = "127.0.0.1:5000"
 		}
+
+		if config.LanguagesPath == "" {
+			config.LanguagesPath = "./languages.json"
+		}
 	}
 
 	return &config, err
 }
+
+func (config *Config) Validate() error {
+	if config.SharedPath == "" {
+		return fmt.Errorf("Shared path is required")
+	}
+
+	if config.LanguagesPath == "" {
+		return fmt.Errorf("Languages path is required")
+	}
+
+	if config.RunDuration <= 0 {
+		return fmt.Errorf("Run duration must be greater than zero")
+	}
+
+	if config.ReadyPoolFill < 0 || config.ReadyPoolFill > 100 {
+		return fmt.Errorf("Ready pool fill must be between 0 and 100")
+	}
+
+	switch config.ThrottleBackend {
+	case "memory":
+	case "redis":
+		if config.RedisAddress == "" {
+			return fmt.Errorf("Redis address is required for redis throttle backend")
+		}
+	default:
+		return fmt.Errorf("Throttle backend must be memory or redis")
+	}
+
+	if _, err := NewIPMatcher(config.TrustedProxies); err != nil {
+		return err
+	}
+
+	if _, err := NewIPMatcher(config.ThrottleWhitelist); err != nil {
+		return err
+	}
+
+	for _, rule := range config.ThrottleRules {
+		if rule.Ip == "" {
+			continue
+		}
+
+		if _, err := NewIPMatcher([]string{rule.Ip}); err != nil {
+			return err
+		}
+	}
+
+	if err := validateLogConfig(config.LogFormat, config.LogLevel); err != nil {
+		return err
+	}
+
+	if err := validateTraceConfig(config); err != nil {
+		return err
+	}
+
+	if config.UsageDaily.ContainerSeconds < 0 || config.UsageDaily.MemorySeconds < 0 || config.UsageDaily.OutputBytes < 0 ||
+		config.UsageMonthly.ContainerSeconds < 0 || config.UsageMonthly.MemorySeconds < 0 || config.UsageMonthly.OutputBytes < 0 {
+		return fmt.Errorf("Usage quotas must not be negative")
+	}
+
+	if config.NamespaceQuota < 0 || config.NamespaceTTL < 0 {
+		return fmt.Errorf("Namespace quota and ttl must not be negative")
+	}
+
+	if config.SessionsPerKey < 0 || config.MaxSessions < 0 || config.SessionIdleTimeout < 0 || config.SessionMaxLifetime < 0 {
+		return fmt.Errorf("Session limits must not be negative")
+	}
+
+	if config.ArtifactTTL < 0 || config.ArtifactMaxFiles < 0 || config.ArtifactMaxBytes < 0 {
+		return fmt.Errorf("Artifact limits must not be negative")
+	}
+
+	if config.HistoryBackend != "file" && config.HistoryBackend != "none" {
+		return fmt.Errorf("History backend must be file or none")
+	}
+
+	if config.HistoryMaxAge < 0 || config.HistoryMaxRecords < 0 || config.HistoryOutputBytes < 0 {
+		return fmt.Errorf("History limits must not be negative")
+	}
+
+	if config.DepsTTL < 0 || config.DepsTimeout < 0 || config.DepsMemoryLimit < 0 {
+		return fmt.Errorf("Dependency limits must not be negative")
+	}
+
+	if config.SnippetTTL < 0 || config.SnippetMaxBytes < 0 || config.SnippetOutputBytes < 0 {
+		return fmt.Errorf("Snippet limits must not be negative")
+	}
+
+	if config.PullPolicy != "" && !validPullPolicy(config.PullPolicy) {
+		return fmt.Errorf("Invalid pull policy: %s", config.PullPolicy)
+	}
+
+	for image, policy := range config.PullPolicies {
+		if !validPullPolicy(policy) {
+			return fmt.Errorf("Invalid pull policy for %s: %s", image, policy)
+		}
+	}
+
+	if config.PullRefreshInterval < 0 {
+		return fmt.Errorf("Pull refresh interval must not be negative")
+	}
+
+	if config.BuildTimeout < 0 {
+		return fmt.Errorf("Build timeout must not be negative")
+	}
+
+	if config.MemoryLimit < 0 {
+		return fmt.Errorf("Memory limit must not be negative")
+	}
+
+	for _, pool := range config.Pools {
+		if pool.Image == "" {
+			return fmt.Errorf("Pool image is required")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigReadyPoolFill(t *testing.T) {
+	examples := []struct {
+		data string
+		fill int
+	}{
+		{`{}`, 50},
+		{`{"ready_pool_fill": 0}`, 0},
+		{`{"ready_pool_fill": 80}`, 80},
+	}
+
+	for _, ex := range examples {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(path, []byte(ex.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := NewConfigFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.ReadyPoolFill != ex.fill {
+			t.Errorf("%s: expected ready pool fill %d, got %d", ex.data, ex.fill, config.ReadyPoolFill)
+		}
+	}
+}
@@ -9,7 +9,21 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 )
 
-func CreateContainer(client *docker.Client, config *Config, image string, standby int, env string) (*docker.Container, error) {
+// ContainerOptions are optional container settings
+type ContainerOptions struct {
+	// Mounted as /code instead of the fresh volume
+	CodePath string
+	// Extra volumes in host:container[:mode] format
+	Binds []string
+	// Enables network regardless of network_disabled config
+	NetworkEnabled bool
+	// Docker network to attach the container to, the default one when empty
+	Network string
+}
+
+// CreateContainer creates a container with a fresh volume mounted as /code and
+// /tmp
+func CreateContainer(client *docker.Client, config *Config, image string, standby int, env string, memory int64, options ContainerOptions) (*docker.Container, error) {
 	id, _ := randomHex(20)
 	volumePath := fmt.Sprintf("%s/%s", config.SharedPath, id)
 	name := fmt.Sprintf("bitrun-%v", time.Now().UnixNano())
@@ -18,33 +32,44 @@ func CreateContainer(client *docker.Client, config *Config, image string, standb
 		return nil, err
 	}
 
+	codePath := options.CodePath
+	if codePath == "" {
+		codePath = volumePath
+	}
+
+	binds := []string{
+		codePath + ":/code",
+		volumePath + ":/tmp",
+	}
+
 	opts := docker.CreateContainerOptions{
 		Name: name,
 		HostConfig: &docker.HostConfig{
-			Binds: []string{
-				volumePath + ":/code",
-				volumePath + ":/tmp",
-			},
+			Binds:          append(binds, options.Binds...),
+			NetworkMode:    options.Network,
 			ReadonlyRootfs: true,
-			Memory:         config.MemoryLimit,
+			Memory:         memory,
 			MemorySwap:     0,
 		},
 		Config: &docker.Config{
 			Hostname:        "bitrun",
 			Image:           image,
-			Labels:          map[string]string{"id": id},
+			Labels:          map[string]string{"id": id, imageDigestLabel: ImageDigest(client, image)},
 			AttachStdout:    false,
 			AttachStderr:    false,
 			AttachStdin:     false,
 			Tty:             false,
-			NetworkDisabled: config.NetworkDisabled,
+			NetworkDisabled: config.NetworkDisabled && !options.NetworkEnabled,
 			WorkingDir:      "/code",
 			Cmd:             []string{"sleep", fmt.Sprintf("%v", standby)},
 			Env:             strings.Split(env, "\n"),
 		},
 	}
 
+	ts := time.Now()
 	container, err := client.CreateContainer(opts)
+	observeDocker("create_container", ts, err)
+
 	if err == nil {
 		container.Config = opts.Config
 	}
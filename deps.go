@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum size of a dependency manifest
+const maxManifestSize = 64 * 1024
+
+// Maximum size of install output included in errors
+const maxInstallOutput = 2048
+
+// Dependencies describes how a language installs dependencies declared in a
+// manifest. Install command runs in /code with the manifest and writes into
+// /deps, which is then mounted read-only into runs.
+type Dependencies struct {
+	Manifest string `json:"manifest"`
+	Command  string `json:"command"`
+	// Environment of install and run containers, e.g. PYTHONPATH=/deps
+	Env []string `json:"env,omitempty"`
+	// Install image, the run image is used when empty
+	Image string `json:"image,omitempty"`
+}
+
+// DepsCache keeps installed dependencies by manifest hash for deps_ttl seconds
+type DepsCache struct {
+	Path  string
+	locks map[string]*depsLock
+	sync.Mutex
+}
+
+type depsLock struct {
+	refs int
+	sync.Mutex
+}
+
+var depsCache *DepsCache
+
+func (deps *Dependencies) Validate() error {
+	if deps == nil {
+		return nil
+	}
+
+	if !validFilename(deps.Manifest) {
+		return fmt.Errorf("Invalid manifest filename")
+	}
+
+	if deps.Command == "" {
+		return fmt.Errorf("Command is required")
+	}
+
+	return nil
+}
+
+func NewDepsCache(config *Config) (*DepsCache, error) {
+	cache := &DepsCache{
+		Path:  depsPath(config),
+		locks: map[string]*depsLock{},
+	}
+
+	return cache, os.MkdirAll(cache.Path, 0755)
+}
+
+func depsPath(config *Config) string {
+	if config.DepsPath != "" {
+		return config.DepsPath
+	}
+
+	return filepath.Join(config.SharedPath, "deps")
+}
+
+// depsKey identifies installed dependencies by everything that affects them
+func depsKey(req *Request) string {
+	return sha1Sum(strings.Join([]string{
+		req.Deps.Image,
+		req.Image,
+		req.Deps.Command,
+		strings.Join(req.Deps.Env, "\n"),
+		req.Deps.Manifest,
+		req.Manifest,
+	}, "\x00"))
+}
+
+// lock serializes installs of the same dependencies
+func (cache *DepsCache) lock(key string) func() {
+	cache.Lock()
+	l := cache.locks[key]
+	if l == nil {
+		l = &depsLock{}
+		cache.locks[key] = l
+	}
+	l.refs++
+	cache.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		cache.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(cache.locks, key)
+		}
+		cache.Unlock()
+	}
+}
+
+// Get returns the path of installed dependencies, installing them first when
+// they are not cached
+func (cache *DepsCache) Get(run *Run) (string, error) {
+	key := depsKey(run.Request)
+	path := filepath.Join(cache.Path, key)
+
+	unlock := cache.lock(key)
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		depsCacheLookups.Inc("hit")
+
+		// Keep used dependencies from expiring
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+
+	depsCacheLookups.Inc("miss")
+
+	tmpPath, err := ioutil.TempDir(cache.Path, ".install-")
+	if err != nil {
+		return "", err
+	}
+
+	// Install container could run as any user
+	if err := os.Chmod(tmpPath, 0777); err != nil {
+		os.RemoveAll(tmpPath)
+		return "", err
+	}
+
+	if err := installDeps(run, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return "", err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.RemoveAll(tmpPath)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// installDeps runs the install command in a separate container with network
+// access, writing dependencies into path
+func installDeps(run *Run, path string) error {
+	req := run.Request
+
+	config := *run.Config
+	config.RunDuration = config.DepsTimeout
+	config.MemoryLimit = config.DepsMemoryLimit
+
+	image := req.Deps.Image
+	if image == "" {
+		image = req.Image
+	}
+
+	// Package managers need a writable home directory
+	env := append([]string{"HOME=/tmp"}, req.Deps.Env...)
+	env = append(env, config.DepsEnv...)
+
+	install := NewRun(&config, run.Client, &Request{
+		Filename: req.Deps.Manifest,
+		Content:  req.Manifest,
+		Command:  req.Deps.Command,
+		Image:    image,
+		Env:      strings.Join(env, "\n"),
+		Language: req.Language,
+	}, run.ClientIP)
+
+	install.Trace = run.Trace
+	install.ContainerOptions = ContainerOptions{
+		Binds:          []string{path + ":/deps"},
+		NetworkEnabled: true,
+		Network:        config.DepsNetwork,
+	}
+
+	// Shutdown waits for the install and destroys it on timeout, same as runs
+	runTracker.Add(install)
+	defer runTracker.End(install)
+	defer install.Destroy()
+
+	run.Log().Info("installing dependencies", "manifest", req.Deps.Manifest, "image", image)
+
+	ts := time.Now()
+	if err := install.Setup(); err != nil {
+		return err
+	}
+
+	result, err := install.StartWithTimeout()
+	runDuration.ObserveSince(ts, "deps")
+
+	if err != nil {
+		if _, ok := err.(*TimeoutError); ok {
+			return fmt.Errorf("Dependency installation timed out after %s", config.DepsTimeout)
+		}
+
+		return err
+	}
+
+	if result.ExitCode != 0 {
+		output := result.Output
+		if len(output) > maxInstallOutput {
+			output = output[len(output)-maxInstallOutput:]
+		}
+
+		return fmt.Errorf("Dependency installation failed with exit code %d: %s", result.ExitCode, output)
+	}
+
+	return nil
+}
+
+// InstallDependencies makes dependencies from the request manifest available
+// to the run as /deps
+func (run *Run) InstallDependencies() error {
+	if depsCache == nil {
+		return fmt.Errorf("Dependencies are not enabled")
+	}
+
+	span := run.Trace.StartSpan("install_deps")
+	path, err := depsCache.Get(run)
+	span.Finish(err)
+
+	if err != nil {
+		return err
+	}
+
+	run.ContainerOptions.Binds = append(run.ContainerOptions.Binds, path+":/deps:ro")
+
+	env := run.Request.Env
+	for _, val := range run.Request.Deps.Env {
+		if env != "" {
+			env += "\n"
+		}
+		env += val
+	}
+	run.Request.Env = env
+
+	return nil
+}
+
+// Cleanup removes dependencies unused for more than deps_ttl and leftovers of
+// interrupted installs
+func (cache *DepsCache) Cleanup() {
+	ttl := CurrentConfig().DepsTTL
+
+	entries, err := ioutil.ReadDir(cache.Path)
+	if err != nil {
+		logger.Error("cant list dependencies", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".install-") {
+			if time.Since(entry.ModTime()) > time.Hour {
+				os.RemoveAll(filepath.Join(cache.Path, entry.Name()))
+			}
+			continue
+		}
+
+		if time.Since(entry.ModTime()) < ttl {
+			continue
+		}
+
+		if err := cache.remove(entry.Name(), ttl); err != nil {
+			logger.Error("cant remove dependencies", "key", entry.Name(), "error", err)
+		}
+	}
+}
+
+// remove deletes dependencies unless they were used while waiting for the lock
+func (cache *DepsCache) remove(key string, ttl time.Duration) error {
+	unlock := cache.lock(key)
+	defer unlock()
+
+	path := filepath.Join(cache.Path, key)
+
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) < ttl {
+		return nil
+	}
+
+	return os.RemoveAll(path)
+}
+
+func (cache *DepsCache) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute * 10)
+			cache.Cleanup()
+		}
+	}()
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-	"io/ioutil"
 	"strings"
 	"time"
 
@@ -11,15 +9,14 @@ import (
 )
 
 func (run *Run) StartExec(container *docker.Container) (*RunResult, error) {
-	run.Container = container
-	run.VolumePath = fmt.Sprintf("%s/%s", run.Config.SharedPath, container.Config.Labels["id"])
-	fullPath := fmt.Sprintf("%s/%s", run.VolumePath, run.Request.Filename)
+	run.setContainer(container)
 
-	if err := ioutil.WriteFile(fullPath, []byte(run.Request.Content), 0666); err != nil {
+	if err := run.writeFile(); err != nil {
 		return nil, err
 	}
 
 	ts := time.Now()
+	span := run.Trace.StartSpan("create_exec")
 
 	exec, err := run.Client.CreateExec(docker.CreateExecOptions{
 		AttachStdout: true,
@@ -28,6 +25,8 @@ func (run *Run) StartExec(container *docker.Container) (*RunResult, error) {
 		Cmd:          []string{"bash", "-c", run.Request.Command},
 		Container:    container.ID,
 	})
+	observeDocker("create_exec", ts, err)
+	span.Finish(err)
 
 	if err != nil {
 		return nil, err
@@ -43,25 +42,39 @@ func (run *Run) StartExec(container *docker.Container) (*RunResult, error) {
 		RawTerminal:  false,
 	}
 
-	if err = run.Client.StartExec(exec.ID, execOpts); err != nil {
+	span = run.Trace.StartSpan("start_exec")
+	tsStart := time.Now()
+	err = run.Client.StartExec(exec.ID, execOpts)
+	observeDocker("start_exec", tsStart, err)
+	span.Finish(err)
+
+	if err != nil {
 		return nil, err
 	}
 
 	result := RunResult{}
 
+	tsInspect := time.Now()
 	execInfo, err := run.Client.InspectExec(exec.ID)
+	observeDocker("inspect_exec", tsInspect, err)
+
 	if err == nil {
 		result.ExitCode = execInfo.ExitCode
 	}
 
 	result.Duration = time.Now().Sub(ts).String()
+	runDuration.ObserveSince(ts, "exec")
 	result.Output = buff.Bytes()
 
+	if container.Config != nil {
+		result.ImageDigest = container.Config.Labels[imageDigestLabel]
+	}
+
 	return &result, nil
 }
 
 func (run *Run) StartExecWithTimeout(container *docker.Container) (*RunResult, error) {
-	duration := run.Config.RunDuration
+	duration := run.Timeout()
 	timeout := time.After(duration)
 	chDone := make(chan Done)
 
@@ -74,6 +87,6 @@ func (run *Run) StartExecWithTimeout(container *docker.Container) (*RunResult, e
 	case done := <-chDone:
 		return done.RunResult, done.error
 	case <-timeout:
-		return nil, fmt.Errorf("Operation timed out after %s", duration.String())
+		return nil, &TimeoutError{duration}
 	}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	gin "github.com/gin-gonic/gin"
+)
+
+type HealthCheck struct {
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type Readiness struct {
+	Status string                  `json:"status"`
+	Checks map[string]*HealthCheck `json:"checks"`
+}
+
+func newHealthCheck(err error) *HealthCheck {
+	if err != nil {
+		return &HealthCheck{Status: "fail", Error: err.Error()}
+	}
+
+	return &HealthCheck{Status: "ok"}
+}
+
+func checkDocker(client *docker.Client) *HealthCheck {
+	ts := time.Now()
+	err := client.Ping()
+	observeDocker("ping", ts, err)
+
+	return newHealthCheck(err)
+}
+
+func checkSharedPath(config *Config) *HealthCheck {
+	file, err := ioutil.TempFile(config.SharedPath, ".readyz")
+	if err != nil {
+		return newHealthCheck(err)
+	}
+
+	file.Close()
+	return newHealthCheck(os.Remove(file.Name()))
+}
+
+// checkLanguageImages reports the state of every language image. Images are
+// checked like before a run, images that are not ready only reject their own
+// runs, so the check fails when none of the images is usable.
+func checkLanguageImages(client *docker.Client) *HealthCheck {
+	check := newHealthCheck(nil)
+	check.Details = map[string]string{}
+	usable := 0
+
+	for _, lang := range GetLanguages() {
+		for _, image := range lang.Images() {
+			if _, exists := check.Details[image]; exists {
+				continue
+			}
+
+			// Same check as checkImageAvailable, then the image must exist,
+			// otherwise containers could not be created from it
+			if err := imageTracker.Check(image); err != nil {
+				check.Details[image] = err.Error()
+				continue
+			}
+
+			if _, err := inspectImage(client, image); err != nil {
+				check.Details[image] = err.Error()
+				continue
+			}
+
+			check.Details[image] = "ok"
+			usable++
+		}
+	}
+
+	if len(check.Details) > 0 && usable == 0 {
+		check.Status = "fail"
+		check.Error = "No language images are available"
+	}
+
+	return check
+}
+
+func checkPools(config *Config) *HealthCheck {
+	check := newHealthCheck(nil)
+	check.Details = map[string]string{}
+
+	for _, pool := range allPools() {
+		// Pools of images that are not ready are not filled yet
+		if imageTracker.Check(pool.Image) != nil {
+			check.Details[pool.Image] = "not ready"
+			continue
+		}
+
+		idle, capacity := pool.Stats()
+		check.Details[pool.Image] = fmt.Sprintf("%v/%v", idle, capacity)
+
+		if idle*100 < capacity*config.ReadyPoolFill {
+			check.Status = "fail"
+		}
+	}
+
+	if check.Status != "ok" {
+		check.Error = fmt.Sprintf("Some pools are filled below %v%%", config.ReadyPoolFill)
+	}
+
+	return check
+}
+
+func checkDraining() *HealthCheck {
+	if runTracker.Draining() {
+		return newHealthCheck(fmt.Errorf("Server is shutting down"))
+	}
+
+	return newHealthCheck(nil)
+}
+
+func HandleHealth(c *gin.Context) {
+	c.JSON(200, map[string]string{"status": "ok"})
+}
+
+func HandleReady(c *gin.Context) {
+	client, exists := c.Get("client")
+	if !exists {
+		errorResponse(400, fmt.Errorf("Cant get client"), c)
+		return
+	}
+
+	config := CurrentConfig()
+
+	result := Readiness{
+		Status: "ok",
+		Checks: map[string]*HealthCheck{
+			"docker":      checkDocker(client.(*docker.Client)),
+			"shared_path": checkSharedPath(config),
+			"images":      checkLanguageImages(client.(*docker.Client)),
+			"pools":       checkPools(config),
+			"draining":    checkDraining(),
+		},
+	}
+
+	status := 200
+
+	for _, check := range result.Checks {
+		if check.Status != "ok" {
+			result.Status = "fail"
+			status = 503
+		}
+	}
+
+	c.JSON(status, result)
+}
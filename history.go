@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// RunRecord describes a completed run for later investigation
+type RunRecord struct {
+	Id              string    `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	ApiKey          string    `json:"api_key,omitempty"`
+	Namespace       string    `json:"namespace,omitempty"`
+	SessionId       string    `json:"session_id,omitempty"`
+	ClientIP        string    `json:"client_ip"`
+	Language        string    `json:"language"`
+	Version         string    `json:"version,omitempty"`
+	Filename        string    `json:"filename,omitempty"`
+	Image           string    `json:"image"`
+	ImageDigest     string    `json:"image_digest,omitempty"`
+	Command         string    `json:"command"`
+	CacheKey        string    `json:"cache_key,omitempty"`
+	ContainerId     string    `json:"container_id,omitempty"`
+	Status          string    `json:"status"`
+	HttpStatus      int       `json:"http_status"`
+	ExitCode        *int      `json:"exit_code,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	Duration        float64   `json:"duration"`
+	ExecDuration    string    `json:"exec_duration,omitempty"`
+	MemoryLimit     int64     `json:"memory_limit"`
+	OutputBytes     int       `json:"output_bytes"`
+	Output          string    `json:"output"`
+	OutputTruncated bool      `json:"output_truncated,omitempty"`
+}
+
+// HistoryFilter selects records, empty fields match any value
+type HistoryFilter struct {
+	ApiKey    string
+	Namespace string
+	Language  string
+	Status    string
+	ClientIP  string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// HistoryStore keeps records of completed runs
+type HistoryStore interface {
+	Add(record *RunRecord) error
+	Get(id string) (*RunRecord, error)
+	// List returns matching records, newest first
+	List(filter HistoryFilter) ([]*RunRecord, error)
+}
+
+var historyStore HistoryStore
+
+// Match reports whether the record satisfies the filter
+func (filter *HistoryFilter) Match(record *RunRecord) bool {
+	if filter.ApiKey != "" && record.ApiKey != filter.ApiKey {
+		return false
+	}
+
+	if filter.Namespace != "" && record.Namespace != filter.Namespace {
+		return false
+	}
+
+	if filter.Language != "" && record.Language != filter.Language {
+		return false
+	}
+
+	if filter.Status != "" && record.Status != filter.Status {
+		return false
+	}
+
+	if filter.ClientIP != "" && record.ClientIP != filter.ClientIP {
+		return false
+	}
+
+	if !filter.Since.IsZero() && record.CreatedAt.Before(filter.Since) {
+		return false
+	}
+
+	if !filter.Until.IsZero() && !record.CreatedAt.Before(filter.Until) {
+		return false
+	}
+
+	return true
+}
+
+// NewHistoryStore creates the store selected in config, nil when disabled
+func NewHistoryStore(config *Config) (HistoryStore, error) {
+	if config.HistoryBackend == "none" {
+		return nil, nil
+	}
+
+	store, err := NewFileHistoryStore(historyPath(config), config.HistoryMaxAge, config.HistoryMaxRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	store.StartPeriodicCleanup()
+	return store, nil
+}
+
+func historyPath(config *Config) string {
+	if config.HistoryPath != "" {
+		return config.HistoryPath
+	}
+
+	return filepath.Join(config.SharedPath, "history.jsonl")
+}
+
+// FileHistoryStore keeps records in memory and appends them to a JSON lines
+// file, so history survives restarts. The file is compacted on cleanup.
+type FileHistoryStore struct {
+	Path       string
+	MaxAge     time.Duration
+	MaxRecords int
+	records    []*RunRecord
+	index      map[string]*RunRecord
+	file       *os.File
+	// Number of pruned records still present in the file
+	stale int
+	sync.RWMutex
+}
+
+func NewFileHistoryStore(path string, maxAge time.Duration, maxRecords int) (*FileHistoryStore, error) {
+	store := &FileHistoryStore{
+		Path:       expandPath(path),
+		MaxAge:     maxAge,
+		MaxRecords: maxRecords,
+		records:    []*RunRecord{},
+		index:      map[string]*RunRecord{},
+	}
+
+	if store.Path == "" {
+		return store, nil
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	return store, store.compact()
+}
+
+func (store *FileHistoryStore) load() error {
+	file, err := os.Open(store.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		record := &RunRecord{}
+
+		// Skip lines broken by a crash in the middle of a write
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			continue
+		}
+
+		store.records = append(store.records, record)
+		store.index[record.Id] = record
+	}
+
+	return scanner.Err()
+}
+
+// prune drops records over retention limits, caller must hold the lock
+func (store *FileHistoryStore) prune() {
+	start := 0
+
+	if store.MaxRecords > 0 && len(store.records) > store.MaxRecords {
+		start = len(store.records) - store.MaxRecords
+	}
+
+	if store.MaxAge > 0 {
+		cutoff := time.Now().Add(-store.MaxAge)
+		for start < len(store.records) && store.records[start].CreatedAt.Before(cutoff) {
+			start++
+		}
+	}
+
+	if start == 0 {
+		return
+	}
+
+	for _, record := range store.records[:start] {
+		delete(store.index, record.Id)
+	}
+
+	store.records = append([]*RunRecord{}, store.records[start:]...)
+	store.stale += start
+}
+
+// compact rewrites the file with retained records, caller must hold the lock
+func (store *FileHistoryStore) compact() error {
+	store.prune()
+	store.stale = 0
+
+	if store.Path == "" {
+		return nil
+	}
+
+	if store.file != nil {
+		store.file.Close()
+		store.file = nil
+	}
+
+	tmpPath := store.Path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for _, record := range store.records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, store.Path); err != nil {
+		return err
+	}
+
+	store.file, err = os.OpenFile(store.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (store *FileHistoryStore) Add(record *RunRecord) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.records = append(store.records, record)
+	store.index[record.Id] = record
+
+	if store.MaxRecords > 0 && len(store.records) > store.MaxRecords {
+		store.prune()
+	}
+
+	if store.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.file.Write(append(data, '\n'))
+	return err
+}
+
+func (store *FileHistoryStore) Get(id string) (*RunRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	record := store.index[id]
+	if record == nil {
+		return nil, fmt.Errorf("Run does not exist")
+	}
+
+	return record, nil
+}
+
+func (store *FileHistoryStore) List(filter HistoryFilter) ([]*RunRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	result := []*RunRecord{}
+
+	for i := len(store.records) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+
+		if filter.Match(store.records[i]) {
+			result = append(result, store.records[i])
+		}
+	}
+
+	return result, nil
+}
+
+// Cleanup applies retention limits and compacts the file
+func (store *FileHistoryStore) Cleanup() {
+	store.Lock()
+	defer store.Unlock()
+
+	store.prune()
+
+	if store.stale == 0 {
+		return
+	}
+
+	if err := store.compact(); err != nil {
+		logger.Error("cant compact run history", "error", err)
+	}
+}
+
+func (store *FileHistoryStore) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute * 10)
+			store.Cleanup()
+		}
+	}()
+}
+
+// recordRun adds a completed run to the history
+func recordRun(c *gin.Context, run *Run, result *RunResult, err error, ts time.Time) {
+	if historyStore == nil {
+		return
+	}
+
+	req := run.Request
+
+	record := &RunRecord{
+		Id:          run.Id,
+		CreatedAt:   ts.UTC(),
+		Namespace:   req.NamespaceId,
+		SessionId:   run.SessionId,
+		ClientIP:    run.ClientIP,
+		Language:    req.Language,
+		Version:     req.Version,
+		Filename:    req.Filename,
+		Image:       req.Image,
+		ImageDigest: run.ImageDigest(),
+		Command:     req.Command,
+		CacheKey:    req.CacheKey,
+		Status:      runStatus(err),
+		HttpStatus:  c.Writer.Status(),
+		Duration:    time.Since(ts).Seconds(),
+		MemoryLimit: run.MemoryLimit(),
+	}
+
+	if key := getApiKey(c); key != nil {
+		record.ApiKey = key.Id
+	}
+
+	run.Lock()
+	if run.Container != nil {
+		record.ContainerId = run.Container.ID
+	}
+	run.Unlock()
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if result != nil {
+		exitCode := result.ExitCode
+		record.ExitCode = &exitCode
+		record.ExecDuration = result.Duration
+		record.OutputBytes = len(result.Output)
+
+		output := result.Output
+		if limit := run.Config.HistoryOutputBytes; len(output) > limit {
+			output = output[:limit]
+			record.OutputTruncated = true
+		}
+
+		record.Output = string(output)
+	}
+
+	if err := historyStore.Add(record); err != nil {
+		run.Log().Error("cant record run history", "error", err)
+	}
+}
+
+// canViewRun reports whether the request could see the record. Admins see
+// all runs, api keys only see their own runs.
+func canViewRun(c *gin.Context, record *RunRecord) bool {
+	if isAdmin(c) {
+		return true
+	}
+
+	key := getApiKey(c)
+	return key != nil && key.Id == record.ApiKey
+}
+
+func HandleGetRun(c *gin.Context) {
+	if historyStore == nil {
+		errorResponse(404, fmt.Errorf("Run history is not enabled"), c)
+		return
+	}
+
+	record, err := historyStore.Get(c.Param("id"))
+	if err != nil || !canViewRun(c, record) {
+		errorResponse(404, fmt.Errorf("Run does not exist"), c)
+		return
+	}
+
+	c.JSON(200, record)
+}
+
+func parseHistoryTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	if ts, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, val)
+}
+
+func HandleListRuns(c *gin.Context) {
+	if historyStore == nil {
+		errorResponse(404, fmt.Errorf("Run history is not enabled"), c)
+		return
+	}
+
+	filter := HistoryFilter{
+		ApiKey:    c.Query("api_key"),
+		Namespace: normalizeString(c.Query("namespace")),
+		Language:  LanguageId(c.Query("language")),
+		Status:    normalizeString(c.Query("status")),
+		ClientIP:  c.Query("client_ip"),
+		Limit:     int(parseInt(c.Query("limit"))),
+	}
+
+	if !isAdmin(c) {
+		key := getApiKey(c)
+		if key == nil {
+			errorResponse(403, fmt.Errorf("Listing runs requires an api key or admin token"), c)
+			return
+		}
+
+		filter.ApiKey = key.Id
+	}
+
+	var err error
+
+	if filter.Since, err = parseHistoryTime(c.Query("since")); err != nil {
+		errorResponse(400, fmt.Errorf("Invalid since parameter"), c)
+		return
+	}
+
+	if filter.Until, err = parseHistoryTime(c.Query("until")); err != nil {
+		errorResponse(400, fmt.Errorf("Invalid until parameter"), c)
+		return
+	}
+
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+
+	records, err := historyStore.List(filter)
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt.After(records[j].CreatedAt)
+	})
+
+	c.JSON(200, records)
+}
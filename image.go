@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Image label with the digest of the image the container was created from
+const imageDigestLabel = "bitrun.image_digest"
+
+// Registry name used for images without a registry host
+const dockerHubRegistry = "https://index.docker.io/v1/"
+
+var pullPolicies = []string{"never", "if_not_present", "always", "refresh"}
+
+// ImageRef is a parsed image reference, e.g. registry:5000/org/image:tag or
+// image@sha256:...
+type ImageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Digests of known images, filled on image checks and pulls
+var (
+	imageDigests      = map[string]string{}
+	imageDigestsMutex sync.RWMutex
+)
+
+// ParseImageRef splits the image name. Registry is only set when the first
+// path component looks like a host, tag defaults to latest unless the image
+// is referenced by digest.
+func ParseImageRef(name string) ImageRef {
+	ref := ImageRef{}
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+	}
+
+	// Colon before the last slash belongs to the registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	ref.Repository = name
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	if i := strings.Index(name, "/"); i > 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+		}
+	}
+
+	return ref
+}
+
+// ImagePullPolicy returns the pull policy of the image. Entries of
+// pull_policies ending with * match by prefix, pull_policy applies to other
+// images.
+func (config *Config) ImagePullPolicy(image string) string {
+	if policy, ok := config.PullPolicies[image]; ok {
+		return policy
+	}
+
+	match := ""
+	for pattern := range config.PullPolicies {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(image, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+
+	if match != "" {
+		return config.PullPolicies[match+"*"]
+	}
+
+	if config.PullPolicy != "" {
+		return config.PullPolicy
+	}
+
+	if config.FetchImages {
+		return "if_not_present"
+	}
+
+	return "never"
+}
+
+func validPullPolicy(policy string) bool {
+	for _, name := range pullPolicies {
+		if name == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// registryAuth returns credentials for the registry from registry_auth_path,
+// a docker config.json file. Empty credentials are used when none match.
+func registryAuth(config *Config, registry string) (docker.AuthConfiguration, error) {
+	if config.RegistryAuthPath == "" {
+		return docker.AuthConfiguration{}, nil
+	}
+
+	auths, err := docker.NewAuthConfigurationsFromFile(config.RegistryAuthPath)
+	if err != nil {
+		return docker.AuthConfiguration{}, fmt.Errorf("Cant load registry auth: %s", err)
+	}
+
+	if registry == "" {
+		registry = dockerHubRegistry
+	}
+
+	registry = registryHost(registry)
+
+	for name, auth := range auths.Configs {
+		if registryHost(name) == registry {
+			return auth, nil
+		}
+	}
+
+	return docker.AuthConfiguration{}, nil
+}
+
+// registryHost strips the scheme and path from a registry address, so
+// https://index.docker.io/v1/ and index.docker.io match
+func registryHost(address string) string {
+	address = strings.TrimPrefix(address, "https://")
+	address = strings.TrimPrefix(address, "http://")
+	address = strings.SplitN(address, "/", 2)[0]
+
+	if address == "docker.io" || address == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+
+	return address
+}
+
+func pullImage(client *docker.Client, config *Config, name string) error {
+	ref := ParseImageRef(name)
+
+	auth, err := registryAuth(config, ref.Registry)
+	if err != nil {
+		return err
+	}
+
+	// Docker pulls by digest when it is given in place of the tag
+	tag := ref.Tag
+	if ref.Digest != "" {
+		tag = ref.Digest
+	}
+
+	progress := newPullProgress(name)
+
+	opts := docker.PullImageOptions{
+		Repository:    ref.Repository,
+		Tag:           tag,
+		OutputStream:  progress,
+		RawJSONStream: true,
+	}
+
+	ts := time.Now()
+	err = client.PullImage(opts, auth)
+	if err == nil {
+		err = progress.err
+	}
+	observeDocker("pull_image", ts, err)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = inspectImage(client, name)
+	return err
+}
+
+// inspectImage looks up a local image by tag or digest reference and records
+// its digest
+func inspectImage(client *docker.Client, name string) (*docker.Image, error) {
+	ts := time.Now()
+	info, err := client.InspectImage(name)
+	observeDocker("inspect_image", ts, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	imageDigestsMutex.Lock()
+	imageDigests[name] = imageDigest(name, info)
+	imageDigestsMutex.Unlock()
+
+	return info, nil
+}
+
+// imageDigest returns the registry digest of the image, or the image id for
+// images that were built locally
+func imageDigest(name string, info *docker.Image) string {
+	ref := ParseImageRef(name)
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+
+	for _, repoDigest := range info.RepoDigests {
+		chunks := strings.SplitN(repoDigest, "@", 2)
+		if len(chunks) == 2 && chunks[0] == ref.Repository {
+			return chunks[1]
+		}
+	}
+
+	if len(info.RepoDigests) > 0 {
+		return strings.SplitN(info.RepoDigests[0], "@", 2)[1]
+	}
+
+	return info.ID
+}
+
+// ImageDigest returns the digest of a local image, empty when it is unknown
+func ImageDigest(client *docker.Client, name string) string {
+	imageDigestsMutex.RLock()
+	digest, ok := imageDigests[name]
+	imageDigestsMutex.RUnlock()
+
+	if ok {
+		return digest
+	}
+
+	if _, err := inspectImage(client, name); err != nil {
+		return ""
+	}
+
+	imageDigestsMutex.RLock()
+	defer imageDigestsMutex.RUnlock()
+
+	return imageDigests[name]
+}
+
+// checkImages records states of language images and starts pulling missing
+// ones in background according to their pull policies. Only docker errors
+// fail the check, images that could not be pulled or built are marked as
+// failed.
+func checkImages(client *docker.Client, config *Config, langs map[string]Language) error {
+	logger.Info("checking images")
+
+	checked := map[string]bool{}
+	builds := languageBuilds(langs)
+	pulls := []string{}
+
+	for _, ext := range sortedExtensions(langs) {
+		lang := langs[ext]
+
+		for _, image := range lang.Images() {
+			if checked[image] {
+				continue
+			}
+			checked[image] = true
+
+			policy := config.ImagePullPolicy(image)
+
+			// Pull or build started before is still running
+			if imageTracker.Pending(image) {
+				continue
+			}
+
+			_, err := inspectImage(client, image)
+			if err != nil && err != docker.ErrNoSuchImage {
+				return err
+			}
+
+			// Built images are never pulled. Missing ones are built after the
+			// check, failed builds are kept as recorded by the builder.
+			if builds[image] != nil {
+				entry := imageTracker.Get(image)
+
+				if err != nil && (entry == nil || entry.State == "ready") {
+					imageTracker.Set(image, "build", "building", nil)
+				} else if err == nil && (entry == nil || entry.State != "ready") {
+					imageTracker.Set(image, "build", "ready", nil)
+				}
+				continue
+			}
+
+			if err == nil {
+				logger.Debug("image exists", "image", image)
+				imageTracker.Set(image, policy, "ready", nil)
+
+				if policy == "always" {
+					pulls = append(pulls, image)
+				}
+				continue
+			}
+
+			if policy == "never" {
+				err := fmt.Errorf("Image does not exist and pull policy is never")
+				logger.Error("image is missing", "image", image, "error", err)
+				imageTracker.Set(image, policy, "failed", err)
+				continue
+			}
+
+			logger.Info("pulling image", "image", image, "policy", policy)
+			imageTracker.Set(image, policy, "pulling", nil)
+			pulls = append(pulls, image)
+		}
+	}
+
+	go pullImages(client, config, pulls)
+
+	return nil
+}
+
+// refreshPolicyImages returns language images with refresh policy, built
+// images are never pulled
+func refreshPolicyImages(config *Config, langs map[string]Language) []string {
+	builds := languageBuilds(langs)
+	images := []string{}
+	seen := map[string]bool{}
+
+	for _, ext := range sortedExtensions(langs) {
+		lang := langs[ext]
+
+		for _, image := range lang.Images() {
+			if seen[image] || builds[image] != nil || config.ImagePullPolicy(image) != "refresh" {
+				continue
+			}
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+
+	return images
+}
+
+// refreshImages pulls images with refresh policy again, so containers created
+// afterwards use the latest image for the tag
+func refreshImages(client *docker.Client) {
+	config := CurrentConfig()
+
+	for _, image := range refreshPolicyImages(config, GetLanguages()) {
+		previous := ImageDigest(client, image)
+
+		if err := pullImage(client, config, image); err != nil {
+			logger.Error("cant refresh image", "image", image, "error", err)
+			continue
+		}
+
+		imageTracker.Set(image, "refresh", "ready", nil)
+
+		if digest := ImageDigest(client, image); digest != previous {
+			logger.Info("image updated", "image", image, "digest", digest, "previous_digest", previous)
+		}
+	}
+}
+
+var (
+	imageRefreshStarted bool
+	imageRefreshMutex   sync.Mutex
+)
+
+// StartImageRefresh starts refreshing images in background once any language
+// image uses refresh policy. Reload calls it again for policies added later.
+func StartImageRefresh(client *docker.Client, config *Config) {
+	if len(refreshPolicyImages(config, GetLanguages())) == 0 {
+		return
+	}
+
+	imageRefreshMutex.Lock()
+	defer imageRefreshMutex.Unlock()
+
+	if imageRefreshStarted {
+		return
+	}
+	imageRefreshStarted = true
+
+	go func() {
+		for {
+			time.Sleep(CurrentConfig().PullRefreshInterval)
+			refreshImages(client)
+		}
+	}()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JwtKey struct {
+	Id     string
+	Secret []byte
+	Public *rsa.PublicKey
+}
+
+type JwtVerifier struct {
+	Keys     []*JwtKey
+	Issuer   string
+	Audience string
+	MaxTTL   time.Duration
+}
+
+// JwtClaims include standard registered claims and limits applied to the run
+type JwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	IssuedAt  int64           `json:"iat"`
+	NotBefore int64           `json:"nbf"`
+	Namespace string          `json:"namespace"`
+	Limits
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+var (
+	jwtVerifier      *JwtVerifier
+	jwtVerifierMutex sync.RWMutex
+)
+
+func getJwtVerifier() *JwtVerifier {
+	jwtVerifierMutex.RLock()
+	defer jwtVerifierMutex.RUnlock()
+
+	return jwtVerifier
+}
+
+func setJwtVerifier(verifier *JwtVerifier) {
+	jwtVerifierMutex.Lock()
+	defer jwtVerifierMutex.Unlock()
+
+	jwtVerifier = verifier
+}
+
+func decodeSegment(seg string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Invalid PEM data")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Public key is not RSA")
+}
+
+func loadJwks(path string) ([]*JwtKey, error) {
+	data, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := []*JwtKey{}
+
+	for _, item := range set.Keys {
+		if item.Use != "" && item.Use != "sig" {
+			continue
+		}
+
+		switch item.Kty {
+		case "oct":
+			secret, err := decodeSegment(item.K)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, &JwtKey{Id: item.Kid, Secret: secret})
+		case "RSA":
+			n, err := decodeSegment(item.N)
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := decodeSegment(item.E)
+			if err != nil {
+				return nil, err
+			}
+
+			pub := &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+			keys = append(keys, &JwtKey{Id: item.Kid, Public: pub})
+		}
+	}
+
+	return keys, nil
+}
+
+// NewJwtVerifier builds a verifier from config, returns nil when JWT auth is not configured
+func NewJwtVerifier(config *Config) (*JwtVerifier, error) {
+	keys := []*JwtKey{}
+
+	if config.JwtSecret != "" {
+		keys = append(keys, &JwtKey{Secret: []byte(config.JwtSecret)})
+	}
+
+	if config.JwtPublicKey != "" {
+		data, err := ioutil.ReadFile(expandPath(config.JwtPublicKey))
+		if err != nil {
+			return nil, err
+		}
+
+		pub, err := parseRSAPublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &JwtKey{Public: pub})
+	}
+
+	if config.JwksPath != "" {
+		jwks, err := loadJwks(config.JwksPath)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, jwks...)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	verifier := &JwtVerifier{
+		Keys:     keys,
+		Issuer:   config.JwtIssuer,
+		Audience: config.JwtAudience,
+		MaxTTL:   config.JwtMaxTTL,
+	}
+
+	return verifier, nil
+}
+
+func looksLikeJwt(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (v *JwtVerifier) verifySignature(header *jwtHeader, signed string, sig []byte) error {
+	for _, key := range v.Keys {
+		if header.Kid != "" && key.Id != "" && header.Kid != key.Id {
+			continue
+		}
+
+		switch {
+		case header.Alg == "HS256" && key.Secret != nil:
+			mac := hmac.New(sha256.New, key.Secret)
+			mac.Write([]byte(signed))
+
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		case header.Alg == "RS256" && key.Public != nil:
+			sum := sha256.Sum256([]byte(signed))
+
+			if rsa.VerifyPKCS1v15(key.Public, crypto.SHA256, sum[:], sig) == nil {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("Token signature is invalid")
+}
+
+func (claims *JwtClaims) hasAudience(audience string) bool {
+	single := ""
+	if json.Unmarshal(claims.Audience, &single) == nil {
+		return single == audience
+	}
+
+	list := []string{}
+	if json.Unmarshal(claims.Audience, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Verify checks token signature and registered claims
+func (v *JwtVerifier) Verify(token string) (*JwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	headerData, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	header := jwtHeader{}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	if header.Alg != "HS256" && header.Alg != "RS256" {
+		return nil, fmt.Errorf("Token algorithm is not supported: %s", header.Alg)
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	if err := v.verifySignature(&header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	claims := JwtClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("Token is malformed")
+	}
+
+	now := time.Now()
+
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("Token expiration is required")
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("Token is expired")
+	}
+
+	if claims.NotBefore > 0 && now.Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("Token is not valid yet")
+	}
+
+	if v.MaxTTL > 0 && time.Unix(claims.ExpiresAt, 0).Sub(now) > v.MaxTTL {
+		return nil, fmt.Errorf("Token lifetime is too long")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("Token subject is required")
+	}
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("Token issuer is invalid")
+	}
+
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return nil, fmt.Errorf("Token audience is invalid")
+	}
+
+	return &claims, nil
+}
+
+// ApiKey represents token claims as an api key, so they are throttled and
+// applied to requests the same way
+func (claims *JwtClaims) ApiKey() *ApiKey {
+	return &ApiKey{
+		Id:        "jwt:" + claims.Subject,
+		Name:      claims.Subject,
+		Enabled:   true,
+		Namespace: claims.Namespace,
+		Limits:    claims.Limits,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+var testJwtSecret = []byte("secret")
+
+func encodeSegment(val interface{}) string {
+	data, _ := json.Marshal(val)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signHS256 builds a token signed with the secret, the header is taken as is
+func signHS256(header map[string]string, claims map[string]interface{}, secret []byte) string {
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(header map[string]string, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testClaims(ttl time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "docs-site",
+		"exp": time.Now().Add(ttl).Unix(),
+	}
+}
+
+func TestJwtVerifyHS256(t *testing.T) {
+	verifier := &JwtVerifier{
+		Keys:     []*JwtKey{{Id: "main", Secret: testJwtSecret}},
+		Issuer:   "bitrun",
+		Audience: "api",
+		MaxTTL:   time.Hour,
+	}
+
+	valid := func() map[string]interface{} {
+		claims := testClaims(time.Minute)
+		claims["iss"] = "bitrun"
+		claims["aud"] = "api"
+		return claims
+	}
+
+	with := func(key string, val interface{}) map[string]interface{} {
+		claims := valid()
+		if val == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = val
+		}
+		return claims
+	}
+
+	header := map[string]string{"alg": "HS256", "kid": "main"}
+
+	examples := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", signHS256(header, valid(), testJwtSecret), ""},
+		{"audience list", signHS256(header, with("aud", []string{"other", "api"}), testJwtSecret), ""},
+		{"without kid", signHS256(map[string]string{"alg": "HS256"}, valid(), testJwtSecret), ""},
+		{"wrong secret", signHS256(header, valid(), []byte("other")), "Token signature is invalid"},
+		{"unknown kid", signHS256(map[string]string{"alg": "HS256", "kid": "old"}, valid(), testJwtSecret), "Token signature is invalid"},
+		{"none algorithm", encodeSegment(map[string]string{"alg": "none"}) + "." + encodeSegment(valid()) + ".", "Token algorithm is not supported: none"},
+		{"expired", signHS256(header, with("exp", time.Now().Add(-time.Second).Unix()), testJwtSecret), "Token is expired"},
+		{"without expiration", signHS256(header, with("exp", nil), testJwtSecret), "Token expiration is required"},
+		{"over max ttl", signHS256(header, with("exp", time.Now().Add(2*time.Hour).Unix()), testJwtSecret), "Token lifetime is too long"},
+		{"not valid yet", signHS256(header, with("nbf", time.Now().Add(time.Minute).Unix()), testJwtSecret), "Token is not valid yet"},
+		{"without subject", signHS256(header, with("sub", nil), testJwtSecret), "Token subject is required"},
+		{"wrong issuer", signHS256(header, with("iss", "other"), testJwtSecret), "Token issuer is invalid"},
+		{"wrong audience", signHS256(header, with("aud", "other"), testJwtSecret), "Token audience is invalid"},
+		{"wrong audience list", signHS256(header, with("aud", []string{"other"}), testJwtSecret), "Token audience is invalid"},
+		{"without audience", signHS256(header, with("aud", nil), testJwtSecret), "Token audience is invalid"},
+		{"malformed", "a.b", "Token is malformed"},
+		{"malformed header", "!!!." + encodeSegment(valid()) + ".sig", "Token is malformed"},
+	}
+
+	for _, ex := range examples {
+		claims, err := verifier.Verify(ex.token)
+
+		if ex.err == "" {
+			if err != nil {
+				t.Errorf("%s: expected token to be valid, got %v", ex.name, err)
+			} else if claims.Subject != "docs-site" {
+				t.Errorf("%s: expected subject docs-site, got %s", ex.name, claims.Subject)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != ex.err {
+			t.Errorf("%s: expected error %q, got %v", ex.name, ex.err, err)
+		}
+	}
+}
+
+func TestJwtVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	parsed, err := parseRSAPublicKey(publicPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &JwtVerifier{
+		Keys:   []*JwtKey{{Id: "rsa", Public: parsed}},
+		MaxTTL: time.Hour,
+	}
+
+	header := map[string]string{"alg": "RS256", "kid": "rsa"}
+
+	examples := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", signRS256(header, testClaims(time.Minute), key), true},
+		{"other key", signRS256(header, testClaims(time.Minute), other), false},
+		{"unknown kid", signRS256(map[string]string{"alg": "RS256", "kid": "other"}, testClaims(time.Minute), key), false},
+		// Public key must never be accepted as an HMAC secret
+		{"public key as hmac secret", signHS256(map[string]string{"alg": "HS256", "kid": "rsa"}, testClaims(time.Minute), publicPem), false},
+		{"public key der as hmac secret", signHS256(map[string]string{"alg": "HS256"}, testClaims(time.Minute), der), false},
+		{"expired", signRS256(header, testClaims(-time.Minute), key), false},
+		{"over max ttl", signRS256(header, testClaims(2*time.Hour), key), false},
+	}
+
+	for _, ex := range examples {
+		_, err := verifier.Verify(ex.token)
+
+		if (err == nil) != ex.valid {
+			t.Errorf("%s: expected valid %v, got error %v", ex.name, ex.valid, err)
+		}
+	}
+}
+
+func TestJwtClaimsApiKey(t *testing.T) {
+	claims := JwtClaims{
+		Subject:   "docs-site",
+		Namespace: "docs",
+		Limits:    Limits{Quota: 10, Languages: []string{"ruby"}},
+	}
+
+	key := claims.ApiKey()
+
+	if key.Id != "jwt:docs-site" || key.Namespace != "docs" || !key.Enabled {
+		t.Errorf("unexpected key: %+v", key)
+	}
+
+	if key.Quota != 10 || !key.LanguageAllowed("ruby") || key.LanguageAllowed("python") {
+		t.Errorf("expected limits to be copied from claims, got %+v", key.Limits)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Limits restrict what a caller is allowed to run. Zero values mean no
+// restriction beyond the global config. Languages are catalogue ids, e.g.
+// python, as set in Request.Language.
+type Limits struct {
+	Languages   []string `json:"languages,omitempty"`
+	MaxDuration int      `json:"max_duration,omitempty"`
+	MaxMemory   int64    `json:"max_memory,omitempty"`
+	Quota       int      `json:"quota,omitempty"`
+	Burst       int      `json:"burst,omitempty"`
+	Window      int      `json:"window,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	Sessions    int      `json:"sessions,omitempty"`
+
+	DailyQuota   *UsageQuota `json:"daily_quota,omitempty"`
+	MonthlyQuota *UsageQuota `json:"monthly_quota,omitempty"`
+}
+
+type ApiKey struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token,omitempty"`
+	TokenHash string     `json:"token_hash,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	Namespace string     `json:"namespace,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Limits
+}
+
+type KeyStore struct {
+	Path string
+	Keys map[string]*ApiKey
+	sync.RWMutex
+}
+
+var keyStore *KeyStore
+
+// LanguageAllowed reports whether the language is permitted. Languages are
+// compared by their catalogue ids, so limits set by extension keep working.
+func (limits *Limits) LanguageAllowed(language string) bool {
+	if len(limits.Languages) == 0 {
+		return true
+	}
+
+	language = LanguageId(language)
+
+	for _, lang := range limits.Languages {
+		if LanguageId(lang) == language {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateLanguages replaces languages given by extension with their ids and
+// rejects languages missing from the catalogue
+func (limits *Limits) validateLanguages() error {
+	for i, lang := range limits.Languages {
+		_, found, err := FindLanguage(strings.TrimPrefix(normalizeString(lang), "."))
+		if err != nil {
+			return err
+		}
+
+		limits.Languages[i] = found.Name
+	}
+
+	return nil
+}
+
+// Apply validates the request against limits and caps its resources. The
+// request must be resolved, so its language is a catalogue id.
+func (limits *Limits) Apply(req *Request) error {
+	if !limits.LanguageAllowed(req.Language) {
+		return fmt.Errorf("Language is not allowed: %s", req.Language)
+	}
+
+	if limits.MaxMemory > 0 && (req.MemoryLimit == 0 || req.MemoryLimit > limits.MaxMemory) {
+		req.MemoryLimit = limits.MaxMemory
+	}
+
+	maxDuration := time.Duration(limits.MaxDuration) * time.Second
+	if maxDuration > 0 && (req.Timeout == 0 || req.Timeout > maxDuration) {
+		req.Timeout = maxDuration
+	}
+
+	return nil
+}
+
+func (key *ApiKey) Expired() bool {
+	return key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now())
+}
+
+func (key *ApiKey) Valid() error {
+	if !key.Enabled {
+		return fmt.Errorf("Api key is disabled")
+	}
+
+	if key.Expired() {
+		return fmt.Errorf("Api key is expired")
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the key without the secret token or its hash
+func (key *ApiKey) Redacted() *ApiKey {
+	result := *key
+	result.Token = ""
+	result.TokenHash = ""
+	return &result
+}
+
+// issueToken generates a new token, only its hash is kept in the store
+func (key *ApiKey) issueToken() string {
+	token, _ := randomHex(20)
+	key.TokenHash = hashToken(token)
+	return token
+}
+
+func NewKeyStore(path string) (*KeyStore, error) {
+	store := &KeyStore{
+		Path: expandPath(path),
+		Keys: map[string]*ApiKey{},
+	}
+
+	return store, store.Load()
+}
+
+func (store *KeyStore) Load() error {
+	data, err := ioutil.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := []*ApiKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	result := map[string]*ApiKey{}
+	migrated := false
+
+	for _, key := range keys {
+		// Plain tokens are replaced by their hashes
+		if key.Token != "" {
+			key.TokenHash = hashToken(key.Token)
+			key.Token = ""
+			migrated = true
+		}
+
+		if key.Id == "" || key.TokenHash == "" {
+			return fmt.Errorf("Api key id and token hash are required")
+		}
+
+		result[key.Id] = key
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	store.Keys = result
+
+	if migrated {
+		return store.save()
+	}
+
+	return nil
+}
+
+// save writes keys to a temporary file and renames it, caller must hold the lock
+func (store *KeyStore) save() error {
+	keys := []*ApiKey{}
+	for _, key := range store.Keys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := store.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, store.Path)
+}
+
+func (store *KeyStore) FindByToken(token string) *ApiKey {
+	hash := hashToken(token)
+
+	store.RLock()
+	defer store.RUnlock()
+
+	var found *ApiKey
+
+	// Compare against every key so timing does not depend on the match position
+	for _, key := range store.Keys {
+		if secureCompare(key.TokenHash, hash) && found == nil {
+			found = key
+		}
+	}
+
+	if found == nil {
+		return nil
+	}
+
+	result := *found
+	return &result
+}
+
+func (store *KeyStore) List() []*ApiKey {
+	store.RLock()
+	defer store.RUnlock()
+
+	keys := []*ApiKey{}
+	for _, key := range store.Keys {
+		keys = append(keys, key.Redacted())
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+func (store *KeyStore) Create(key *ApiKey) (*ApiKey, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	key.Id, _ = randomHex(6)
+	key.Token = ""
+	key.CreatedAt = time.Now().UTC()
+	token := key.issueToken()
+	store.Keys[key.Id] = key
+
+	if err := store.save(); err != nil {
+		delete(store.Keys, key.Id)
+		return nil, err
+	}
+
+	result := key.Redacted()
+	result.Token = token
+	return result, nil
+}
+
+// clone returns a copy of the key that shares no pointers or slices with it,
+// so decoding onto the copy leaves the key untouched
+func (key *ApiKey) clone() *ApiKey {
+	result := *key
+
+	if key.ExpiresAt != nil {
+		expiresAt := *key.ExpiresAt
+		result.ExpiresAt = &expiresAt
+	}
+
+	if key.Languages != nil {
+		result.Languages = append([]string{}, key.Languages...)
+	}
+
+	if key.DailyQuota != nil {
+		quota := *key.DailyQuota
+		result.DailyQuota = &quota
+	}
+
+	if key.MonthlyQuota != nil {
+		quota := *key.MonthlyQuota
+		result.MonthlyQuota = &quota
+	}
+
+	return &result
+}
+
+// Update merges settings from the json body onto the key, fields missing from
+// the body are kept. Id, token and creation time can not be changed.
+func (store *KeyStore) Update(id string, data []byte) (*ApiKey, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	key := store.Keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("Api key does not exist")
+	}
+
+	update := key.clone()
+	if err := json.Unmarshal(data, update); err != nil {
+		return nil, err
+	}
+
+	if err := update.validateLanguages(); err != nil {
+		return nil, err
+	}
+
+	prev := *key
+	update.Id = key.Id
+	update.Token = ""
+	update.TokenHash = key.TokenHash
+	update.CreatedAt = key.CreatedAt
+	*key = *update
+
+	if err := store.save(); err != nil {
+		*key = prev
+		return nil, err
+	}
+
+	return key.Redacted(), nil
+}
+
+func (store *KeyStore) Rotate(id string) (*ApiKey, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	key := store.Keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("Api key does not exist")
+	}
+
+	prevHash := key.TokenHash
+	token := key.issueToken()
+
+	if err := store.save(); err != nil {
+		key.TokenHash = prevHash
+		return nil, err
+	}
+
+	result := key.Redacted()
+	result.Token = token
+	return result, nil
+}
+
+func (store *KeyStore) Revoke(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	key := store.Keys[id]
+	if key == nil {
+		return fmt.Errorf("Api key does not exist")
+	}
+
+	delete(store.Keys, id)
+
+	if err := store.save(); err != nil {
+		store.Keys[id] = key
+		return err
+	}
+
+	return nil
+}
+
+func getApiKey(c *gin.Context) *ApiKey {
+	if key, exists := c.Get("api_key"); exists {
+		return key.(*ApiKey)
+	}
+
+	return nil
+}
+
+func requireKeyStore(c *gin.Context) bool {
+	if keyStore == nil {
+		errorResponse(404, fmt.Errorf("Api keys are not enabled"), c)
+		return false
+	}
+
+	return true
+}
+
+func HandleListKeys(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+
+	c.JSON(200, keyStore.List())
+}
+
+func HandleCreateKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+
+	key := ApiKey{Enabled: true}
+	if err := json.NewDecoder(c.Request.Body).Decode(&key); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	if key.Name == "" {
+		errorResponse(400, fmt.Errorf("Name is required"), c)
+		return
+	}
+
+	if err := key.validateLanguages(); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	result, err := keyStore.Create(&key)
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(201, result)
+}
+
+func HandleUpdateKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	result, err := keyStore.Update(c.Param("id"), data)
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func HandleRotateKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+
+	result, err := keyStore.Rotate(c.Param("id"))
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func HandleRevokeKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+
+	if err := keyStore.Revoke(c.Param("id")); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "revoked"})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreUpdate(t *testing.T) {
+	withTestLanguages(t, testSessionLanguages)
+
+	store, err := NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC()
+	created, err := store.Create(&ApiKey{
+		Name:      "docs",
+		Enabled:   true,
+		Namespace: "docs",
+		ExpiresAt: &expiresAt,
+		Limits:    Limits{Languages: []string{"ruby"}, Quota: 20, DailyQuota: &UsageQuota{ContainerSeconds: 100}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial update keeps fields missing from the body
+	key, err := store.Update(created.Id, []byte(`{"quota": 5, "languages": [".py"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !key.Enabled || key.Name != "docs" || key.Namespace != "docs" || key.ExpiresAt == nil || key.DailyQuota == nil {
+		t.Errorf("expected key settings to be kept, got %+v", key)
+	}
+
+	if key.Quota != 5 || len(key.Languages) != 1 || key.Languages[0] != "python" {
+		t.Errorf("expected quota and languages to be updated, got %+v", key.Limits)
+	}
+
+	if key.Id != created.Id || !key.CreatedAt.Equal(created.CreatedAt) || store.FindByToken(created.Token) == nil {
+		t.Errorf("expected id, token and creation time to be kept, got %+v", key)
+	}
+
+	// Invalid update leaves the stored key untouched
+	if _, err := store.Update(created.Id, []byte(`{"enabled": false, "languages": ["cobol"]}`)); err == nil {
+		t.Errorf("expected unknown language to be rejected")
+	}
+
+	stored := store.Keys[created.Id]
+	if !stored.Enabled || stored.Languages[0] != "python" {
+		t.Errorf("expected rejected update not to change the key, got %+v", stored)
+	}
+
+	key, err = store.Update(created.Id, []byte(`{"enabled": false, "expires_at": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Enabled || key.ExpiresAt != nil || key.Quota != 5 {
+		t.Errorf("expected key to be disabled without expiration, got %+v", key)
+	}
+
+	if _, err := store.Update("missing", []byte(`{}`)); err == nil {
+		t.Errorf("expected missing key to be rejected")
+	}
+}
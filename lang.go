@@ -5,53 +5,430 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// Language describes how files with an extension are run. Languages could
+// declare multiple versions, image and command then refer to the default one.
 type Language struct {
+	Name        string             `json:"name"`
+	DisplayName string             `json:"display_name"`
+	Image       string             `json:"image"`
+	Command     string             `json:"command"`
+	Format      string             `json:"format"`
+	Versions    []*LanguageVersion `json:"versions,omitempty"`
+	Example     string             `json:"example,omitempty"`
+	// Dependency installation from a manifest, e.g. requirements.txt
+	Dependencies *Dependencies `json:"dependencies,omitempty"`
+	// Image is built from this definition instead of being pulled
+	Build *BuildSpec `json:"build,omitempty"`
+
+	// Detection hints: filename glob patterns, shebang interpreters and
+	// regular expressions matched against content of files without extension
+	Filenames       []string `json:"filenames,omitempty"`
+	Shebangs        []string `json:"shebangs,omitempty"`
+	ContentPatterns []string `json:"content_patterns,omitempty"`
+	contentRegexps  []*regexp.Regexp
+}
+
+// LanguageVersion is a named runtime of a language, e.g. python@3.5
+type LanguageVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
 	Image   string `json:"image"`
 	Command string `json:"command"`
-	Format  string `json:"format"`
+	Default bool   `json:"default,omitempty"`
+	// Language dependencies settings are used when not set
+	Dependencies *Dependencies `json:"dependencies,omitempty"`
+	Build        *BuildSpec    `json:"build,omitempty"`
 }
 
-var Extensions map[string]Language
+var VersionRegexp = regexp.MustCompile(`\A[a-z\d\.\-\_]{1,32}\z`)
+
+// Extensions is replaced as a whole on reload and must not be modified in place
+var (
+	Extensions      map[string]Language
+	extensionsMutex sync.RWMutex
+)
 
 func ValidLanguage(ext string) bool {
-	for k, _ := range Extensions {
-		if k == ext {
-			return true
-		}
-	}
+	extensionsMutex.RLock()
+	defer extensionsMutex.RUnlock()
 
-	return false
+	_, ok := Extensions[ext]
+	return ok
 }
 
 func GetLanguageConfig(filename string) (*Language, error) {
 	ext := filepath.Ext(strings.ToLower(filename))
 
-	if !ValidLanguage(ext) {
+	extensionsMutex.RLock()
+	lang, ok := Extensions[ext]
+	extensionsMutex.RUnlock()
+
+	if !ok {
 		return nil, fmt.Errorf("Extension is not supported: %s", ext)
 	}
 
-	lang := Extensions[ext]
 	return &lang, nil
 }
 
-func LoadLanguages(file string) error {
+// FindLanguage finds a language by its name or extension and returns the
+// extension it is declared for
+func FindLanguage(name string) (string, *Language, error) {
+	langs := GetLanguages()
+
+	if lang, ok := langs["."+name]; ok {
+		return "." + name, &lang, nil
+	}
+
+	for _, ext := range sortedExtensions(langs) {
+		if lang := langs[ext]; lang.Name == name {
+			return ext, &lang, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("Language is not supported: %s", name)
+}
+
+// LanguageId returns the canonical id of a language, the name it is listed
+// under in the catalogue, e.g. python for "py", ".py" or "python". Unknown
+// languages are returned as is.
+func LanguageId(name string) string {
+	name = normalizeString(name)
+
+	if _, lang, err := FindLanguage(strings.TrimPrefix(name, ".")); err == nil {
+		return lang.Name
+	}
+
+	return name
+}
+
+// DetectLanguage finds the language of a file and returns the extension it is
+// declared for. Explicit language, filename patterns and the extension are
+// tried in this order. Shebang line and content patterns are only used for
+// files without an extension.
+func DetectLanguage(filename string, content string, language string) (string, *Language, error) {
+	if language != "" {
+		return FindLanguage(language)
+	}
+
+	langs := GetLanguages()
+	exts := sortedExtensions(langs)
+
+	for _, ext := range exts {
+		lang := langs[ext]
+		for _, pattern := range lang.Filenames {
+			if ok, _ := filepath.Match(pattern, filename); ok {
+				return ext, &lang, nil
+			}
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != "" {
+		lang, ok := langs[ext]
+		if !ok {
+			return "", nil, fmt.Errorf("Extension is not supported: %s", ext)
+		}
+
+		return ext, &lang, nil
+	}
+
+	if interpreter := shebangInterpreter(content); interpreter != "" {
+		for _, ext := range exts {
+			lang := langs[ext]
+			for _, name := range lang.Shebangs {
+				if name == interpreter {
+					return ext, &lang, nil
+				}
+			}
+		}
+	}
+
+	for _, ext := range exts {
+		lang := langs[ext]
+		for _, re := range lang.contentRegexps {
+			if re.MatchString(content) {
+				return ext, &lang, nil
+			}
+		}
+	}
+
+	return "", nil, fmt.Errorf("Language could not be detected, use language parameter")
+}
+
+// shebangInterpreter returns interpreter name from the shebang line, e.g.
+// python3 for "#!/usr/bin/env python3"
+func shebangInterpreter(content string) string {
+	if !strings.HasPrefix(content, "#!") {
+		return ""
+	}
+
+	line := strings.SplitN(content[2:], "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interpreter := filepath.Base(fields[0])
+
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+
+	return interpreter
+}
+
+func sortedExtensions(langs map[string]Language) []string {
+	exts := []string{}
+	for ext := range langs {
+		exts = append(exts, ext)
+	}
+
+	sort.Strings(exts)
+	return exts
+}
+
+// Version finds a version by its name, either "3.5" or "python@3.5". Empty
+// name selects the default version.
+func (lang *Language) Version(name string) (*LanguageVersion, error) {
+	if len(lang.Versions) == 0 {
+		if name != "" && name != lang.Name {
+			return nil, fmt.Errorf("Version is not supported: %s", name)
+		}
+
+		return &LanguageVersion{
+			Name:         lang.Name,
+			Image:        lang.Image,
+			Command:      lang.Command,
+			Default:      true,
+			Dependencies: lang.Dependencies,
+		}, nil
+	}
+
+	version := strings.TrimPrefix(name, lang.Name+"@")
+
+	for _, v := range lang.Versions {
+		if (version == "" && v.Default) || v.Version == version {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Version is not supported: %s", name)
+}
+
+// Images returns images of all language versions
+func (lang *Language) Images() []string {
+	if len(lang.Versions) == 0 {
+		return []string{lang.Image}
+	}
+
+	images := []string{}
+	for _, v := range lang.Versions {
+		images = append(images, v.Image)
+	}
+
+	return images
+}
+
+// ImageAllowed reports whether the image could be requested explicitly. Images
+// of configured languages are always allowed, other images must match an entry
+// of image_allowlist, entries ending with * match by prefix.
+func ImageAllowed(config *Config, image string) bool {
+	for _, lang := range GetLanguages() {
+		for _, known := range lang.Images() {
+			if known == image {
+				return true
+			}
+		}
+	}
+
+	for _, entry := range config.ImageAllowlist {
+		if strings.HasSuffix(entry, "*") && strings.HasPrefix(image, strings.TrimSuffix(entry, "*")) {
+			return true
+		}
+
+		if entry == image {
+			return true
+		}
+	}
+
+	return false
+}
+
+func GetLanguages() map[string]Language {
+	extensionsMutex.RLock()
+	defer extensionsMutex.RUnlock()
+
+	return Extensions
+}
+
+func SetLanguages(langs map[string]Language) {
+	extensionsMutex.Lock()
+	defer extensionsMutex.Unlock()
+
+	Extensions = langs
+}
+
+func ParseLanguages(file string) (map[string]Language, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	langs := map[string]Language{}
+
+	if err := json.Unmarshal(data, &langs); err != nil {
+		return nil, err
 	}
 
-	err = json.Unmarshal(data, &Extensions)
+	if len(langs) == 0 {
+		return nil, fmt.Errorf("No languages defined in %s", file)
+	}
+
+	for k, lang := range langs {
+		if !strings.HasPrefix(k, ".") {
+			return nil, fmt.Errorf("Invalid extension: %s", k)
+		}
+
+		if lang.Name == "" {
+			lang.Name = strings.TrimPrefix(k, ".")
+		}
+
+		if lang.DisplayName == "" {
+			lang.DisplayName = lang.Name
+		}
+
+		if len(lang.Versions) > 0 {
+			if lang.Build != nil {
+				return nil, fmt.Errorf("Build must be defined per version for %s", k)
+			}
+
+			if err := parseVersions(k, &lang); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := lang.Build.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid build for %s: %s", k, err)
+		}
+
+		if err := lang.Dependencies.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid dependencies for %s: %s", k, err)
+		}
+
+		for _, pattern := range lang.Filenames {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid filename pattern for %s: %s", k, pattern)
+			}
+		}
+
+		lang.contentRegexps = []*regexp.Regexp{}
+		for _, pattern := range lang.ContentPatterns {
+			re, err := regexp.Compile("(?m)" + pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid content pattern for %s: %s", k, pattern)
+			}
+
+			lang.contentRegexps = append(lang.contentRegexps, re)
+		}
+
+		if lang.Image == "" {
+			return nil, fmt.Errorf("Image is required for %s", k)
+		}
+
+		if lang.Command == "" {
+			return nil, fmt.Errorf("Command is required for %s", k)
+		}
 
-	for k, lang := range Extensions {
 		if lang.Format == "" {
 			lang.Format = "text/plain"
 		}
 
-		Extensions[k] = lang
+		langs[k] = lang
+	}
+
+	return langs, nil
+}
+
+// parseVersions validates language versions and selects the default one. Top
+// level command is used for versions without their own command.
+func parseVersions(ext string, lang *Language) error {
+	var defaultVersion *LanguageVersion
+	seen := map[string]bool{}
+
+	for _, v := range lang.Versions {
+		if !VersionRegexp.MatchString(v.Version) {
+			return fmt.Errorf("Invalid version for %s: %s", ext, v.Version)
+		}
+
+		if seen[v.Version] {
+			return fmt.Errorf("Duplicate version for %s: %s", ext, v.Version)
+		}
+		seen[v.Version] = true
+
+		if v.Image == "" {
+			return fmt.Errorf("Image is required for %s version %s", ext, v.Version)
+		}
+
+		if v.Command == "" {
+			v.Command = lang.Command
+		}
+
+		if v.Command == "" {
+			return fmt.Errorf("Command is required for %s version %s", ext, v.Version)
+		}
+
+		if v.Dependencies == nil {
+			v.Dependencies = lang.Dependencies
+		}
+
+		if err := v.Dependencies.Validate(); err != nil {
+			return fmt.Errorf("Invalid dependencies for %s version %s: %s", ext, v.Version, err)
+		}
+
+		if err := v.Build.Validate(); err != nil {
+			return fmt.Errorf("Invalid build for %s version %s: %s", ext, v.Version, err)
+		}
+
+		v.Name = lang.Name + "@" + v.Version
+
+		if v.Default || len(lang.Versions) == 1 {
+			if defaultVersion != nil {
+				return fmt.Errorf("Only one default version is allowed for %s", ext)
+			}
+
+			v.Default = true
+			defaultVersion = v
+		}
+	}
+
+	if defaultVersion == nil {
+		return fmt.Errorf("Default version is required for %s", ext)
+	}
+
+	lang.Image = defaultVersion.Image
+	lang.Command = defaultVersion.Command
+
+	return nil
+}
+
+func LoadLanguages(file string) error {
+	langs, err := ParseLanguages(file)
+	if err != nil {
+		return err
 	}
 
-	return err
+	SetLanguages(langs)
+	return nil
 }
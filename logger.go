@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+)
+
+func validateLogConfig(format string, level string) error {
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("Log format must be logfmt or json")
+	}
+
+	if _, ok := logLevels[level]; !ok {
+		return fmt.Errorf("Log level must be debug, info, warn or error")
+	}
+
+	return nil
+}
+
+// setupLogger must be called once on startup, later changes only affect log level
+func setupLogger(config *Config) {
+	logLevel.Set(logLevels[config.LogLevel])
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	if config.LogFormat == "json" {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// logAccess writes a single access record for a completed run
+func (run *Run) logAccess(c *gin.Context, result *RunResult, err error, ts time.Time) {
+	attrs := []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration_ms", time.Since(ts).Milliseconds(),
+		"command", run.Request.Command,
+	}
+
+	if result != nil {
+		attrs = append(attrs, "exit_code", result.ExitCode, "output_bytes", len(result.Output))
+	}
+
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+
+	run.Log().Info("run completed", attrs...)
+}
+
+// requestLogMiddleware logs requests that are not covered by run access records
+func requestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ts := time.Now()
+		c.Next()
+
+		if _, exists := c.Get("run"); exists {
+			return
+		}
+
+		logger.Debug("request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(ts).Milliseconds(),
+			"client_ip", clientIP(c),
+		)
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
 )
@@ -14,100 +12,139 @@ const VERSION = "0.3.1"
 func requireEnvVar(name string) {
 	if os.Getenv(name) == "" {
 		err := fmt.Errorf("Please set %s environment variable", name)
-		log.Fatalln(err)
+		fatal("missing environment variable", err)
 	}
 }
 
-func getConfig() *Config {
+func loadConfig() (*Config, error) {
+	var config *Config
+	var err error
+
 	if os.Getenv("CONFIG") != "" {
-		config, err := NewConfigFromFile(os.Getenv("CONFIG"))
+		config, err = NewConfigFromFile(os.Getenv("CONFIG"))
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
+	} else {
+		config = NewConfig()
+	}
 
-		return config
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
-	requireEnvVar("DOCKER_HOST")
-	requireEnvVar("SHARED_PATH")
+	config.trustedProxies, _ = NewIPMatcher(config.TrustedProxies)
 
-	return NewConfig()
+	return config, nil
 }
 
-func pullImage(name string, client *docker.Client) error {
-	chunks := strings.Split(name, ":")
+func getConfig() *Config {
+	if os.Getenv("CONFIG") == "" {
+		requireEnvVar("DOCKER_HOST")
+		requireEnvVar("SHARED_PATH")
+	}
 
-	imgName := chunks[0]
-	imgTag := "latest"
+	config, err := loadConfig()
+	if err != nil {
+		fatal("invalid config", err)
+	}
+
+	return config
+}
+
+func main() {
+	logger.Info("bitrun api", "version", VERSION)
 
-	if len(chunks) == 2 {
-		imgTag = chunks[1]
+	config := getConfig()
+	setupLogger(config)
+	setupTracer(config)
+
+	// Background workers read the current config
+	SetCurrentConfig(config)
+
+	err := LoadLanguages(config.LanguagesPath)
+	if err != nil {
+		fatal("cant load languages", err)
 	}
 
-	auth := docker.AuthConfiguration{}
-	opts := docker.PullImageOptions{
-		Repository:   imgName,
-		Tag:          imgTag,
-		OutputStream: os.Stdout,
+	client, err := docker.NewClient(config.DockerHost)
+	if err != nil {
+		fatal("cant create docker client", err)
 	}
 
-	return client.PullImage(opts, auth)
-}
+	imageBuilder = NewBuilder(client)
 
-func checkImages(client *docker.Client, config *Config) error {
-	images, err := client.ListImages(docker.ListImagesOptions{})
+	imageBuilder.BuildAll(GetLanguages(), false)
+
+	err = checkImages(client, config, GetLanguages())
 	if err != nil {
-		log.Fatalln(err)
+		fatal("image check failed", err)
 	}
 
-	imagesWithTags := map[string]bool{}
+	StartImageRefresh(client, config)
 
-	for _, image := range images {
-		for _, tag := range image.RepoTags {
-			imagesWithTags[tag] = true
+	if config.KeysPath != "" {
+		keyStore, err = NewKeyStore(config.KeysPath)
+		if err != nil {
+			fatal("cant load api keys", err)
 		}
 	}
 
-	fmt.Println("checking images...")
-	for _, lang := range Extensions {
-		if imagesWithTags[lang.Image] == true {
-			log.Printf("image %s exists", lang.Image)
-		} else {
-			if config.FetchImages {
-				log.Println("pulling", lang.Image, "image...")
-				err := pullImage(lang.Image, client)
-				if err != nil {
-					log.Fatalln(err)
-				}
-			} else {
-				return fmt.Errorf("image %s does not exist", lang.Image)
-			}
+	if config.Namespaces {
+		namespaceStore, err = NewNamespaceStore(config)
+		if err != nil {
+			fatal("cant create namespaces path", err)
 		}
+
+		namespaceStore.StartPeriodicCleanup()
 	}
 
-	return nil
-}
+	if config.Sessions {
+		sessionManager = NewSessionManager(client)
+		sessionManager.StartPeriodicCleanup()
+	}
 
-func main() {
-	log.Printf("bitrun api v%s\n", VERSION)
+	artifactStore, err = NewArtifactStore(config)
+	if err != nil {
+		fatal("cant create artifacts path", err)
+	}
 
-	config := getConfig()
+	artifactStore.StartPeriodicCleanup()
 
-	err := LoadLanguages(config.LanguagesPath)
+	if config.Deps {
+		depsCache, err = NewDepsCache(config)
+		if err != nil {
+			fatal("cant create deps path", err)
+		}
+
+		depsCache.StartPeriodicCleanup()
+	}
+
+	snippetStore, err = NewSnippetStore(config)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("cant create snippets path", err)
 	}
 
-	client, err := docker.NewClient(config.DockerHost)
+	snippetStore.StartPeriodicCleanup()
+
+	historyStore, err = NewHistoryStore(config)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("cant load run history", err)
 	}
 
-	err = checkImages(client, config)
+	usageTracker, err = NewUsageTracker(config)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("cant load usage", err)
 	}
 
+	verifier, err := NewJwtVerifier(config)
+	if err != nil {
+		fatal("cant load jwt keys", err)
+	}
+
+	setJwtVerifier(verifier)
+	go watchReloadSignal(client)
+
 	go RunPool(config, client)
 	RunApi(config, client)
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Minimal metrics registry producing Prometheus text exposition format
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsRegistry      []metricWriter
+	metricsRegistryMutex sync.Mutex
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+func registerMetric(m metricWriter) {
+	metricsRegistryMutex.Lock()
+	defer metricsRegistryMutex.Unlock()
+
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+func escapeLabelValue(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `"`, `\"`, -1)
+	return strings.Replace(val, "\n", `\n`, -1)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := []string{}
+
+	for i, name := range names {
+		val := ""
+		if i < len(values) {
+			val = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(val)))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(val float64) string {
+	if math.IsInf(val, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+	values map[string]float64
+	labels map[string][]string
+	sync.Mutex
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: map[string]float64{},
+		labels: map[string][]string{},
+	}
+
+	registerMetric(c)
+	return c
+}
+
+func (c *Counter) Add(val float64, labels ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := seriesKey(labels)
+	c.values[key] += val
+	c.labels[key] = labels
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	writeHeader(w, c.Name, c.Help, "counter")
+	for _, key := range sortedKeys(c.labels) {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, c.labels[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+	series  map[string]*histogramSeries
+	labels  map[string][]string
+	sync.Mutex
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: buckets,
+		series:  map[string]*histogramSeries{},
+		labels:  map[string][]string{},
+	}
+
+	registerMetric(h)
+	return h
+}
+
+func (h *Histogram) Observe(val float64, labels ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := seriesKey(labels)
+	series := h.series[key]
+
+	if series == nil {
+		series = &histogramSeries{counts: make([]uint64, len(h.Buckets))}
+		h.series[key] = series
+		h.labels[key] = labels
+	}
+
+	for i, bound := range h.Buckets {
+		if val <= bound {
+			series.counts[i]++
+		}
+	}
+
+	series.count++
+	series.sum += val
+}
+
+func (h *Histogram) ObserveSince(ts time.Time, labels ...string) {
+	h.Observe(time.Since(ts).Seconds(), labels...)
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.Name, h.Help, "histogram")
+	for _, key := range sortedKeys(h.labels) {
+		series := h.series[key]
+		labels := h.labels[key]
+
+		for i, bound := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %v\n", h.Name, formatLabels(h.Labels, labels, "le", formatFloat(bound)), series.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %v\n", h.Name, formatLabels(h.Labels, labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, labels), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %v\n", h.Name, formatLabels(h.Labels, labels), series.count)
+	}
+}
+
+// Gauge collects its samples at scrape time
+type Gauge struct {
+	Name    string
+	Help    string
+	Labels  []string
+	collect func() []GaugeSample
+}
+
+type GaugeSample struct {
+	Labels []string
+	Value  float64
+}
+
+func NewGaugeFunc(name string, help string, collect func() []GaugeSample, labels ...string) *Gauge {
+	g := &Gauge{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		collect: collect,
+	}
+
+	registerMetric(g)
+	return g
+}
+
+func (g *Gauge) writeTo(w io.Writer) {
+	samples := g.collect()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return seriesKey(samples[i].Labels) < seriesKey(samples[j].Labels)
+	})
+
+	writeHeader(w, g.Name, g.Help, "gauge")
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.Name, formatLabels(g.Labels, sample.Labels), formatFloat(sample.Value))
+	}
+}
+
+var (
+	runsTotal = NewCounter(
+		"bitrun_runs_total",
+		"Number of completed runs.",
+		"language", "status", "exit_code",
+	)
+
+	runDuration = NewHistogram(
+		"bitrun_run_duration_seconds",
+		"Duration of run phases: container setup, exec and total.",
+		defaultBuckets,
+		"phase",
+	)
+
+	poolHits = NewCounter(
+		"bitrun_pool_hits_total",
+		"Number of runs served by a warmed-up container.",
+		"image",
+	)
+
+	poolMisses = NewCounter(
+		"bitrun_pool_misses_total",
+		"Number of runs that found the pool empty.",
+		"image",
+	)
+
+	poolRefillErrors = NewCounter(
+		"bitrun_pool_refill_errors_total",
+		"Number of errors while adding containers to a pool.",
+		"image",
+	)
+
+	depsCacheLookups = NewCounter(
+		"bitrun_deps_cache_total",
+		"Number of dependency cache lookups by result: hit or miss.",
+		"result",
+	)
+
+	throttleRejections = NewCounter(
+		"bitrun_throttle_rejections_total",
+		"Number of requests rejected by the throttler.",
+	)
+
+	quotaRejections = NewCounter(
+		"bitrun_quota_rejections_total",
+		"Number of runs rejected because of exhausted usage quotas.",
+		"period",
+	)
+
+	dockerDuration = NewHistogram(
+		"bitrun_docker_request_duration_seconds",
+		"Latency of Docker API calls.",
+		defaultBuckets,
+		"operation",
+	)
+
+	dockerErrors = NewCounter(
+		"bitrun_docker_errors_total",
+		"Number of failed Docker API calls.",
+		"operation",
+	)
+
+	_ = NewGaugeFunc(
+		"bitrun_pool_size",
+		"Configured pool capacity.",
+		func() []GaugeSample {
+			samples := []GaugeSample{}
+			for _, pool := range allPools() {
+				_, capacity := pool.Stats()
+				samples = append(samples, GaugeSample{[]string{pool.Image}, float64(capacity)})
+			}
+			return samples
+		},
+		"image",
+	)
+
+	_ = NewGaugeFunc(
+		"bitrun_pool_idle",
+		"Number of idle containers in a pool.",
+		func() []GaugeSample {
+			samples := []GaugeSample{}
+			for _, pool := range allPools() {
+				idle, _ := pool.Stats()
+				samples = append(samples, GaugeSample{[]string{pool.Image}, float64(idle)})
+			}
+			return samples
+		},
+		"image",
+	)
+
+	_ = NewGaugeFunc(
+		"bitrun_sessions",
+		"Number of open sessions.",
+		func() []GaugeSample {
+			if sessionManager == nil {
+				return []GaugeSample{}
+			}
+			return []GaugeSample{{nil, float64(sessionManager.Count())}}
+		},
+	)
+
+	_ = NewGaugeFunc(
+		"bitrun_runs_in_flight",
+		"Number of runs currently being executed.",
+		func() []GaugeSample {
+			return []GaugeSample{{nil, float64(runTracker.Count())}}
+		},
+	)
+)
+
+// observeDocker records latency and errors of a Docker API call started at ts
+func observeDocker(operation string, ts time.Time, err error) {
+	dockerDuration.ObserveSince(ts, operation)
+
+	if err != nil {
+		dockerErrors.Inc(operation)
+	}
+}
+
+// runStatus returns ok, error or timeout depending on the run error
+func runStatus(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	if _, ok := err.(*TimeoutError); ok {
+		return "timeout"
+	}
+
+	return "error"
+}
+
+func observeRun(req *Request, result *RunResult, err error, ts time.Time) {
+	status := runStatus(err)
+	exitCode := ""
+
+	if err == nil {
+		exitCode = strconv.Itoa(result.ExitCode)
+	}
+
+	runsTotal.Inc(req.Language, status, exitCode)
+	runDuration.ObserveSince(ts, "total")
+}
+
+func HandleMetrics(c *gin.Context) {
+	buff := bytes.NewBuffer([]byte{})
+
+	metricsRegistryMutex.Lock()
+	for _, m := range metricsRegistry {
+		m.writeTo(buff)
+	}
+	metricsRegistryMutex.Unlock()
+
+	c.Data(200, "text/plain; version=0.0.4; charset=utf-8", buff.Bytes())
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// NamespaceStore manages persistent workspaces. Each namespace is a directory
+// mounted as /code into run containers, only one run could use it at a time.
+type NamespaceStore struct {
+	Path   string
+	Quota  int64
+	TTL    time.Duration
+	locked map[string]bool
+	sync.Mutex
+}
+
+type Namespace struct {
+	Name string
+	Path string
+	// Api key id of the creator, empty for callers without a key
+	Owner string
+}
+
+type NamespaceFile struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+var NamespaceRegexp = regexp.MustCompile(`\A[a-z\d\-\_]{1,64}\z`)
+
+var (
+	errNamespaceBusy     = fmt.Errorf("Namespace is used by another run")
+	errNamespaceNotFound = fmt.Errorf("Namespace does not exist")
+	errNamespaceQuota    = fmt.Errorf("Namespace disk quota exceeded")
+	errNamespaceOwner    = fmt.Errorf("Namespace is not allowed")
+)
+
+var namespaceStore *NamespaceStore
+
+// namespaceWatchInterval is how often namespace size is checked during runs
+const namespaceWatchInterval = time.Second
+
+func namespacesPath(config *Config) string {
+	if config.NamespacesPath != "" {
+		return config.NamespacesPath
+	}
+
+	return filepath.Join(config.SharedPath, "namespaces")
+}
+
+func NewNamespaceStore(config *Config) (*NamespaceStore, error) {
+	store := &NamespaceStore{
+		Path:   namespacesPath(config),
+		locked: map[string]bool{},
+	}
+
+	store.Configure(config)
+
+	return store, os.MkdirAll(store.Path, 0777)
+}
+
+// settings returns disk quota and TTL, they could change on reload
+func (store *NamespaceStore) settings() (int64, time.Duration) {
+	store.Lock()
+	defer store.Unlock()
+
+	return store.Quota, store.TTL
+}
+
+func (store *NamespaceStore) Configure(config *Config) {
+	store.Lock()
+	defer store.Unlock()
+
+	store.Quota = config.NamespaceQuota
+	store.TTL = config.NamespaceTTL
+}
+
+// Acquire locks the namespace exclusively, it fails right away if the
+// namespace is already locked
+func (store *NamespaceStore) Acquire(name string) error {
+	if !NamespaceRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid namespace")
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if store.locked[name] {
+		return errNamespaceBusy
+	}
+
+	store.locked[name] = true
+	return nil
+}
+
+// Release unlocks the namespace and marks it as recently used
+func (store *NamespaceStore) Release(name string) {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.locked, name)
+
+	now := time.Now()
+	os.Chtimes(filepath.Join(store.Path, name), now, now)
+}
+
+// ownerPath returns the file with the namespace owner. It is kept next to the
+// namespace directory, which is writable by runs. Names could not contain dots,
+// so it never clashes with another namespace.
+func (store *NamespaceStore) ownerPath(name string) string {
+	return filepath.Join(store.Path, name+".owner")
+}
+
+// Get returns a namespace locked by the caller, creating its directory if needed.
+// New namespaces are owned by the given owner.
+func (store *NamespaceStore) Get(name string, create bool, owner string) (*Namespace, error) {
+	ns := &Namespace{
+		Name: name,
+		Path: filepath.Join(store.Path, name),
+	}
+
+	if _, err := os.Stat(ns.Path); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if !create {
+			return nil, errNamespaceNotFound
+		}
+
+		if err := ioutil.WriteFile(store.ownerPath(name), []byte(owner), 0600); err != nil {
+			return nil, err
+		}
+
+		if err := os.Mkdir(ns.Path, 0777); err != nil {
+			return nil, err
+		}
+
+		// Directory is created with umask applied, containers may run as any user
+		if err := os.Chmod(ns.Path, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(store.ownerPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ns.Owner = string(data)
+
+	return ns, nil
+}
+
+// CheckQuota returns an error when namespace files take more than the quota
+func (store *NamespaceStore) CheckQuota(ns *Namespace) error {
+	quota, _ := store.settings()
+	if quota <= 0 {
+		return nil
+	}
+
+	size, err := ns.Size()
+	if err != nil {
+		return err
+	}
+
+	if size >= quota {
+		return errNamespaceQuota
+	}
+
+	return nil
+}
+
+// CheckUsage returns an error when a run left more files in the namespace than
+// the quota allows
+func (store *NamespaceStore) CheckUsage(ns *Namespace) error {
+	quota, _ := store.settings()
+	if quota <= 0 {
+		return nil
+	}
+
+	size, err := ns.Size()
+	if err != nil {
+		return err
+	}
+
+	if size > quota {
+		return errNamespaceQuota
+	}
+
+	return nil
+}
+
+// Expires returns the time namespace will be removed if not used
+func (store *NamespaceStore) Expires(ns *Namespace) *time.Time {
+	_, ttl := store.settings()
+
+	info, err := os.Stat(ns.Path)
+	if err != nil || ttl <= 0 {
+		return nil
+	}
+
+	expires := info.ModTime().Add(ttl).UTC()
+	return &expires
+}
+
+// Watch checks the namespace size while a run is going and calls exceeded once
+// files take more than the quota. The returned function stops watching and
+// reports whether the quota was exceeded.
+func (store *NamespaceStore) Watch(ns *Namespace, exceeded func()) func() bool {
+	quota, _ := store.settings()
+	if quota <= 0 {
+		return func() bool { return false }
+	}
+
+	done := make(chan bool)
+	result := make(chan bool, 1)
+
+	go func() {
+		ticker := time.NewTicker(namespaceWatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				result <- false
+				return
+			case <-ticker.C:
+				if size, err := ns.Size(); err == nil && size > quota {
+					exceeded()
+					result <- true
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-result
+	}
+}
+
+// Cleanup removes namespaces that were not used for longer than TTL. Expired
+// namespaces stay locked while they are removed, so runs could not use them.
+func (store *NamespaceStore) Cleanup() {
+	store.Lock()
+
+	if store.TTL <= 0 {
+		store.Unlock()
+		return
+	}
+
+	entries, err := ioutil.ReadDir(store.Path)
+	if err != nil {
+		store.Unlock()
+		logger.Error("cant list namespaces", "error", err)
+		return
+	}
+
+	expired := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || store.locked[entry.Name()] {
+			continue
+		}
+
+		if time.Since(entry.ModTime()) < store.TTL {
+			continue
+		}
+
+		store.locked[entry.Name()] = true
+		expired = append(expired, entry.Name())
+	}
+
+	store.Unlock()
+
+	for _, name := range expired {
+		logger.Info("removing expired namespace", "namespace", name)
+
+		if err := os.RemoveAll(filepath.Join(store.Path, name)); err != nil {
+			logger.Error("cant remove namespace", "namespace", name, "error", err)
+		} else {
+			os.Remove(store.ownerPath(name))
+		}
+
+		store.Lock()
+		delete(store.locked, name)
+		store.Unlock()
+	}
+}
+
+func (store *NamespaceStore) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute * 10)
+			store.Cleanup()
+		}
+	}()
+}
+
+// Size returns the total size of regular files in the namespace
+func (ns *Namespace) Size() (int64, error) {
+	var size int64
+
+	err := filepath.Walk(ns.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func (ns *Namespace) Files() ([]NamespaceFile, error) {
+	files := []NamespaceFile{}
+
+	err := filepath.Walk(ns.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ns.Path, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, NamespaceFile{
+			Path:       filepath.ToSlash(rel),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().UTC(),
+		})
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, err
+}
+
+// resolvePath returns the host path of a file inside of root. Files are written
+// by untrusted code, so symlinks must not point outside of root.
+func resolvePath(rootPath string, path string) (string, error) {
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return "", fmt.Errorf("File path is required")
+	}
+
+	root, err := filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Join(rootPath, filepath.Dir(path)))
+	if err != nil {
+		return "", fmt.Errorf("File does not exist")
+	}
+
+	if !insidePath(root, dir) {
+		return "", fmt.Errorf("File does not exist")
+	}
+
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func insidePath(root string, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// openFile opens a regular file inside of root for reading
+func openFile(root string, path string) (*os.File, os.FileInfo, error) {
+	fullPath, err := resolvePath(root, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("File does not exist")
+	}
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, fmt.Errorf("File does not exist")
+	}
+
+	// Processes left running in a container could replace the file with a
+	// symlink after the check, make sure the opened file is inside of root
+	realRoot, _ := filepath.EvalSymlinks(root)
+	if realPath, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", file.Fd())); err == nil && !insidePath(realRoot, realPath) {
+		file.Close()
+		return nil, nil, fmt.Errorf("File does not exist")
+	}
+
+	return file, info, nil
+}
+
+// serveFile responds with a regular file inside of root
+func serveFile(c *gin.Context, root string, path string) {
+	file, info, err := openFile(root, path)
+	if err != nil {
+		errorResponse(404, err, c)
+		return
+	}
+	defer file.Close()
+
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+}
+
+func (ns *Namespace) RemoveFile(path string) error {
+	fullPath, err := resolvePath(ns.Path, path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(fullPath); err != nil {
+		return fmt.Errorf("File does not exist")
+	}
+
+	return os.RemoveAll(fullPath)
+}
+
+// WriteFile replaces a file in the namespace root, removing whatever a previous
+// run left at the same path so the write could not follow a symlink
+func (ns *Namespace) WriteFile(name string, data []byte) error {
+	fullPath := filepath.Join(ns.Path, name)
+
+	if err := os.RemoveAll(fullPath); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (ns *Namespace) Remove() error {
+	if err := os.RemoveAll(ns.Path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(namespaceStore.ownerPath(ns.Name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// namespaceOwner identifies the caller as a namespace owner: api key id, or
+// jwt subject as "jwt:<sub>". Callers without a key share the empty owner.
+func namespaceOwner(c *gin.Context) string {
+	if key := getApiKey(c); key != nil {
+		return key.Id
+	}
+
+	return ""
+}
+
+// checkNamespaceOwner rejects callers other than the namespace owner, admin
+// could access any namespace
+func checkNamespaceOwner(c *gin.Context, ns *Namespace) error {
+	if isAdmin(c) || ns.Owner == namespaceOwner(c) {
+		return nil
+	}
+
+	return errNamespaceOwner
+}
+
+// openNamespace locks the namespace for a run, the caller must release it
+func openNamespace(c *gin.Context, name string) (*Namespace, error) {
+	if err := namespaceStore.Acquire(name); err != nil {
+		return nil, err
+	}
+
+	ns, err := namespaceStore.Get(name, true, namespaceOwner(c))
+	if err == nil {
+		err = checkNamespaceOwner(c, ns)
+	}
+	if err == nil {
+		err = namespaceStore.CheckQuota(ns)
+	}
+
+	if err != nil {
+		namespaceStore.Release(name)
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+// withNamespace locks the namespace from the url for the duration of the handler
+func withNamespace(c *gin.Context, fn func(ns *Namespace)) {
+	if namespaceStore == nil {
+		errorResponse(404, fmt.Errorf("Namespaces are not enabled"), c)
+		return
+	}
+
+	name := normalizeString(c.Param("name"))
+
+	if key := getApiKey(c); key != nil && key.Namespace != "" && key.Namespace != name {
+		errorResponse(403, fmt.Errorf("Namespace is not allowed"), c)
+		return
+	}
+
+	if err := namespaceStore.Acquire(name); err != nil {
+		status := 400
+		if err == errNamespaceBusy {
+			status = 409
+		}
+
+		errorResponse(status, err, c)
+		return
+	}
+	defer namespaceStore.Release(name)
+
+	ns, err := namespaceStore.Get(name, false, "")
+	if err != nil {
+		errorResponse(404, err, c)
+		return
+	}
+
+	if err := checkNamespaceOwner(c, ns); err != nil {
+		errorResponse(403, err, c)
+		return
+	}
+
+	fn(ns)
+}
+
+func HandleNamespace(c *gin.Context) {
+	withNamespace(c, func(ns *Namespace) {
+		files, err := ns.Files()
+		if err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+
+		var size int64
+		for _, file := range files {
+			size += file.Size
+		}
+
+		quota, _ := namespaceStore.settings()
+
+		c.JSON(200, map[string]interface{}{
+			"name":       ns.Name,
+			"size":       size,
+			"quota":      quota,
+			"expires_at": namespaceStore.Expires(ns),
+			"files":      files,
+		})
+	})
+}
+
+func HandleNamespaceFile(c *gin.Context) {
+	withNamespace(c, func(ns *Namespace) {
+		serveFile(c, ns.Path, c.Param("path"))
+	})
+}
+
+func HandleDeleteNamespaceFile(c *gin.Context) {
+	withNamespace(c, func(ns *Namespace) {
+		if err := ns.RemoveFile(c.Param("path")); err != nil {
+			errorResponse(404, err, c)
+			return
+		}
+
+		c.JSON(200, map[string]string{"status": "deleted"})
+	})
+}
+
+func HandleDeleteNamespace(c *gin.Context) {
+	withNamespace(c, func(ns *Namespace) {
+		if err := ns.Remove(); err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+
+		c.JSON(200, map[string]string{"status": "deleted"})
+	})
+}
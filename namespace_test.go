@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testNamespaceStore(t *testing.T, quota int64, ttl time.Duration) *NamespaceStore {
+	store, err := NewNamespaceStore(&Config{
+		NamespacesPath: t.TempDir(),
+		NamespaceQuota: quota,
+		NamespaceTTL:   ttl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestNamespaceWatch(t *testing.T) {
+	store := testNamespaceStore(t, 10, 0)
+
+	ns, err := store.Get("docs", true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Watch(ns, func() { t.Errorf("expected quota not to be exceeded") })() {
+		t.Errorf("expected watch to report quota is not exceeded")
+	}
+
+	exceeded := make(chan bool, 1)
+	stop := store.Watch(ns, func() { exceeded <- true })
+
+	// Run writes past the quota while it is going
+	if err := ioutil.WriteFile(filepath.Join(ns.Path, "data.txt"), []byte("more than ten bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exceeded:
+	case <-time.After(3 * namespaceWatchInterval):
+		t.Fatal("expected run to be stopped")
+	}
+
+	if !stop() {
+		t.Errorf("expected watch to report exceeded quota")
+	}
+}
+
+func TestNamespaceCleanup(t *testing.T) {
+	store := testNamespaceStore(t, 0, time.Hour)
+
+	for _, name := range []string{"expired", "busy", "fresh"} {
+		if _, err := store.Get(name, true, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(store.Path, "expired"), old, old)
+	os.Chtimes(filepath.Join(store.Path, "busy"), old, old)
+
+	if err := store.Acquire("busy"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Cleanup()
+
+	if _, err := os.Stat(filepath.Join(store.Path, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expected expired namespace to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(store.ownerPath("expired")); !os.IsNotExist(err) {
+		t.Errorf("expected owner of expired namespace to be removed, got %v", err)
+	}
+
+	for _, name := range []string{"busy", "fresh"} {
+		if _, err := os.Stat(filepath.Join(store.Path, name)); err != nil {
+			t.Errorf("expected %s namespace to be kept, got %v", name, err)
+		}
+	}
+
+	// Removed namespace is unlocked, so it could be created again
+	if err := store.Acquire("expired"); err != nil {
+		t.Errorf("expected removed namespace to be unlocked, got %v", err)
+	}
+}
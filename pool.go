@@ -2,15 +2,18 @@ package main
 
 import (
 	"fmt"
-	"log"
-
 	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 )
 
-var pools map[string]*Pool
+var (
+	pools      = map[string]*Pool{}
+	poolsMutex sync.RWMutex
+)
+
+var errPoolStopped = fmt.Errorf("pool is stopped")
 
 type Pool struct {
 	Config     *Config
@@ -19,34 +22,26 @@ type Pool struct {
 	Image      string
 	Capacity   int
 	Standby    int
+	stop       chan bool
+	stopOnce   sync.Once
+	destroyed  bool
 	sync.Mutex
 }
 
-func findImage(client *docker.Client, image string) (*docker.APIImages, error) {
-	images, err := client.ListImages(docker.ListImagesOptions{})
-	if err != nil {
-		return nil, err
-	}
-
-	for _, img := range images {
-		for _, t := range img.RepoTags {
-			if t == image {
-				return &img, nil
-			}
-		}
+func normalizeStandby(standby int) int {
+	if standby <= 60 {
+		return 86400
 	}
 
-	return nil, fmt.Errorf("invalid image:", image)
+	return standby
 }
 
 func NewPool(config *Config, client *docker.Client, image string, capacity int, standby int) (*Pool, error) {
-	_, err := findImage(client, image)
-	if err != nil {
-		return nil, err
-	}
-
-	if standby <= 60 {
-		standby = 86400
+	// Pools of images being pulled or built start filling once they are ready
+	if !imageTracker.Pending(image) {
+		if _, err := inspectImage(client, image); err != nil {
+			return nil, fmt.Errorf("invalid image: %s", image)
+		}
 	}
 
 	pool := &Pool{
@@ -55,21 +50,55 @@ func NewPool(config *Config, client *docker.Client, image string, capacity int,
 		Containers: map[string]*docker.Container{},
 		Image:      image,
 		Capacity:   capacity,
-		Standby:    standby,
+		Standby:    normalizeStandby(standby),
+		stop:       make(chan bool),
 	}
 
 	return pool, nil
 }
 
+func getPool(image string) *Pool {
+	poolsMutex.RLock()
+	defer poolsMutex.RUnlock()
+
+	return pools[image]
+}
+
+func allPools() []*Pool {
+	poolsMutex.RLock()
+	defer poolsMutex.RUnlock()
+
+	result := []*Pool{}
+	for _, pool := range pools {
+		result = append(result, pool)
+	}
+
+	return result
+}
+
 func (pool *Pool) Exists(id string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
 	return pool.Containers[id] != nil
 }
 
+// Stats returns the number of idle containers and the pool capacity
+func (pool *Pool) Stats() (int, int) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	return len(pool.Containers), pool.Capacity
+}
+
 func (pool *Pool) Load() error {
 	pool.Lock()
 	defer pool.Unlock()
 
+	ts := time.Now()
 	containers, err := pool.Client.ListContainers(docker.ListContainersOptions{All: true})
+	observeDocker("list_containers", ts, err)
+
 	if err != nil {
 		return err
 	}
@@ -88,37 +117,79 @@ func (pool *Pool) Load() error {
 	return nil
 }
 
+// stopped reports whether pool monitoring was stopped
+func (pool *Pool) stopped() bool {
+	select {
+	case <-pool.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (pool *Pool) Add() error {
-	container, err := CreateContainer(pool.Client, pool.Config, pool.Image, pool.Standby, "")
+	if pool.stopped() {
+		return errPoolStopped
+	}
+
+	pool.Lock()
+	config, standby := pool.Config, pool.Standby
+	pool.Unlock()
+
+	container, err := CreateContainer(pool.Client, config, pool.Image, standby, "", config.MemoryLimit, ContainerOptions{})
 	if err != nil {
 		return err
 	}
 
-	if err = pool.Client.StartContainer(container.ID, nil); err != nil {
+	ts := time.Now()
+	err = pool.Client.StartContainer(container.ID, nil)
+	observeDocker("start_container", ts, err)
+
+	if err != nil {
+		go destroyContainer(pool.Client, container.ID)
 		return err
 	}
 
 	pool.Lock()
 	defer pool.Unlock()
 
+	// Pool could be stopped while the container was starting
+	if pool.destroyed || pool.stopped() {
+		go destroyContainer(pool.Client, container.ID)
+		return errPoolStopped
+	}
+
 	pool.Containers[container.ID] = container
 	return nil
 }
 
 func (pool *Pool) Fill() {
+	pool.Lock()
 	num := pool.Capacity - len(pool.Containers)
+	standby := pool.Standby
+	pool.Unlock()
 
 	// Pool is full
 	if num <= 0 {
 		return
 	}
 
-	log.Printf("adding %v containers to %v pool, standby: %vs\n", num, pool.Image, pool.Standby)
+	if err := imageTracker.Check(pool.Image); err != nil {
+		logger.Debug("pool image is not ready", "image", pool.Image, "error", err)
+		return
+	}
+
+	logger.Info("filling pool", "image", pool.Image, "count", num, "standby", standby)
 
 	for i := 0; i < num; i++ {
 		err := pool.Add()
+		if err == errPoolStopped {
+			return
+		}
+
 		if err != nil {
-			log.Println("error while adding to pool:", err)
+			logger.Error("error while adding to pool", "image", pool.Image, "error", err)
+			poolRefillErrors.Inc(pool.Image)
 		}
 	}
 }
@@ -126,7 +197,53 @@ func (pool *Pool) Fill() {
 func (pool *Pool) Monitor() {
 	for {
 		pool.Fill()
-		time.Sleep(time.Second * 3)
+
+		select {
+		case <-pool.stop:
+			return
+		case <-time.After(time.Second * 3):
+		}
+	}
+}
+
+// Update applies new pool settings, trimming containers above the new capacity
+func (pool *Pool) Update(config *Config, capacity int, standby int) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.Config = config
+	pool.Capacity = capacity
+	pool.Standby = normalizeStandby(standby)
+
+	for id := range pool.Containers {
+		if len(pool.Containers) <= pool.Capacity {
+			break
+		}
+
+		go destroyContainer(pool.Client, id)
+		delete(pool.Containers, id)
+	}
+}
+
+// StopMonitor terminates pool monitoring and leaves idle containers running
+func (pool *Pool) StopMonitor() {
+	pool.stopOnce.Do(func() {
+		close(pool.stop)
+	})
+}
+
+// Stop terminates pool monitoring and destroys all idle containers
+func (pool *Pool) Stop() {
+	pool.StopMonitor()
+
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.destroyed = true
+
+	for id := range pool.Containers {
+		go destroyContainer(pool.Client, id)
+		delete(pool.Containers, id)
 	}
 }
 
@@ -159,13 +276,82 @@ func (pool *Pool) Get() (*docker.Container, error) {
 	return nil, fmt.Errorf("no contaienrs are available")
 }
 
+// ReconcilePools creates, updates and removes pools to match the config.
+// New pools are validated before any running pool is touched.
+func ReconcilePools(config *Config, client *docker.Client) error {
+	wanted := map[string]PoolConfig{}
+
+	for _, cfg := range config.Pools {
+		if cfg.Capacity < 1 {
+			continue
+		}
+
+		wanted[cfg.Image] = cfg
+	}
+
+	created := map[string]*Pool{}
+
+	for image, cfg := range wanted {
+		if getPool(image) != nil {
+			continue
+		}
+
+		pool, err := NewPool(config, client, image, cfg.Capacity, cfg.Standby)
+		if err != nil {
+			return err
+		}
+
+		if err := pool.Load(); err != nil {
+			return err
+		}
+
+		created[image] = pool
+	}
+
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	for image, pool := range pools {
+		cfg, ok := wanted[image]
+		if !ok {
+			logger.Info("removing pool", "image", image)
+			pool.Stop()
+			delete(pools, image)
+			continue
+		}
+
+		pool.Update(config, cfg.Capacity, cfg.Standby)
+	}
+
+	for image, pool := range created {
+		logger.Info("initializing pool", "image", image)
+		go pool.Monitor()
+		pools[image] = pool
+	}
+
+	return nil
+}
+
+// ShutdownPools stops all pools. Kept containers are adopted by the next
+// process when it loads the pool.
+func ShutdownPools(keep bool) {
+	for _, pool := range allPools() {
+		if keep {
+			logger.Info("keeping pool containers", "image", pool.Image)
+			pool.StopMonitor()
+		} else {
+			logger.Info("destroying pool containers", "image", pool.Image)
+			pool.Stop()
+		}
+	}
+}
+
 func RunPool(config *Config, client *docker.Client) {
 	chEvents := make(chan *docker.APIEvents)
-	pools = make(map[string]*Pool)
 
 	// Setup docker event listener
 	if err := client.AddEventListener(chEvents); err != nil {
-		log.Fatalln(err)
+		fatal("cant listen to docker events", err)
 	}
 
 	go func() {
@@ -176,9 +362,9 @@ func RunPool(config *Config, client *docker.Client) {
 			}
 
 			if event.Status == "die" {
-				for _, pool := range pools {
+				for _, pool := range allPools() {
 					if pool.Exists(event.ID) {
-						log.Println("pool's container got destroyed:", event.ID)
+						logger.Info("pool container got destroyed", "image", pool.Image, "container_id", event.ID)
 						pool.Remove(event.ID)
 					}
 				}
@@ -186,24 +372,7 @@ func RunPool(config *Config, client *docker.Client) {
 		}
 	}()
 
-	for _, cfg := range config.Pools {
-		if cfg.Capacity < 1 {
-			continue
-		}
-
-		log.Println("initializing pool for:", cfg.Image)
-
-		pool, err := NewPool(config, client, cfg.Image, cfg.Capacity, cfg.Standby)
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		err = pool.Load()
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		go pool.Monitor()
-		pools[cfg.Image] = pool
+	if err := ReconcilePools(config, client); err != nil {
+		fatal("cant initialize pools", err)
 	}
 }
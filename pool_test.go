@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeDocker serves the docker api calls made while filling pools. Starting
+// a container blocks until release is closed.
+type fakeDocker struct {
+	created  int
+	removed  []string
+	starting chan bool
+	release  chan bool
+	sync.Mutex
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/images/"):
+		fmt.Fprint(w, `{"Id": "sha256:abc"}`)
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		d.Lock()
+		d.created++
+		id := fmt.Sprintf("container-%d", d.created)
+		d.Unlock()
+
+		w.WriteHeader(201)
+		fmt.Fprintf(w, `{"Id": %q}`, id)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/start"):
+		select {
+		case d.starting <- true:
+		default:
+		}
+
+		<-d.release
+		w.WriteHeader(204)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/containers/"):
+		d.Lock()
+		d.removed = append(d.removed, strings.TrimPrefix(r.URL.Path, "/containers/"))
+		d.Unlock()
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestPoolFillStop(t *testing.T) {
+	fake := &fakeDocker{starting: make(chan bool, 1), release: make(chan bool)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &Pool{
+		Config:     &Config{SharedPath: t.TempDir()},
+		Client:     client,
+		Containers: map[string]*docker.Container{},
+		Image:      "bitrun/ruby:2.2",
+		Capacity:   3,
+		Standby:    86400,
+		stop:       make(chan bool),
+	}
+
+	done := make(chan bool)
+	go func() {
+		pool.Fill()
+		close(done)
+	}()
+
+	// Pool is stopped while its first container is starting
+	<-fake.starting
+	pool.Stop()
+	close(fake.release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected fill to return after stop")
+	}
+
+	// Container is destroyed in the background
+	deadline := time.Now().Add(time.Second)
+	for {
+		fake.Lock()
+		created, removed := fake.created, len(fake.removed)
+		fake.Unlock()
+
+		if removed > 0 || time.Now().After(deadline) {
+			if created != 1 || removed != 1 {
+				t.Errorf("expected 1 container to be created and removed, got %d and %d", created, removed)
+			}
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if idle, _ := pool.Stats(); idle != 0 {
+		t.Errorf("expected stopped pool to be empty, got %d containers", idle)
+	}
+}
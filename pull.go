@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	gin "github.com/gin-gonic/gin"
+)
+
+// Number of images pulled at the same time
+const maxConcurrentPulls = 4
+
+// Seconds clients are asked to wait for an image being pulled
+const pullRetryAfter = 30
+
+// ImageState is the availability of a language image
+type ImageState struct {
+	Image  string `json:"image"`
+	State  string `json:"state"`
+	Policy string `json:"policy"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Progress of the current pull, sizes are in bytes
+	Status    string    `json:"status,omitempty"`
+	Current   int64     `json:"current"`
+	Total     int64     `json:"total"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ImageTracker keeps states of language images: pulling, building, ready or
+// failed
+type ImageTracker struct {
+	States map[string]*ImageState
+	sync.Mutex
+}
+
+// pullProgress decodes the JSON stream of a pull and reports the progress
+type pullProgress struct {
+	Image  string
+	layers map[string]*pullLayer
+	buff   []byte
+	err    error
+}
+
+type pullLayer struct {
+	Current int64
+	Total   int64
+}
+
+type pullMessage struct {
+	Id             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+var imageTracker = NewImageTracker()
+
+func NewImageTracker() *ImageTracker {
+	return &ImageTracker{
+		States: map[string]*ImageState{},
+	}
+}
+
+// Set changes the image state and resets pull progress
+func (tracker *ImageTracker) Set(image string, policy string, state string, err error) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	entry := &ImageState{
+		Image:     image,
+		State:     state,
+		Policy:    policy,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if state == "ready" {
+		imageDigestsMutex.RLock()
+		entry.Digest = imageDigests[image]
+		imageDigestsMutex.RUnlock()
+	}
+
+	tracker.States[image] = entry
+}
+
+// Progress updates the pull progress of a tracked image
+func (tracker *ImageTracker) Progress(image string, status string, current int64, total int64) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	entry := tracker.States[image]
+	if entry == nil {
+		return
+	}
+
+	entry.Status = status
+	entry.Current = current
+	entry.Total = total
+	entry.UpdatedAt = time.Now().UTC()
+}
+
+func (tracker *ImageTracker) Get(image string) *ImageState {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	entry := tracker.States[image]
+	if entry == nil {
+		return nil
+	}
+
+	result := *entry
+	return &result
+}
+
+// List returns states of all tracked images ordered by image name
+func (tracker *ImageTracker) List() []ImageState {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	states := []ImageState{}
+	for _, entry := range tracker.States {
+		states = append(states, *entry)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Image < states[j].Image
+	})
+
+	return states
+}
+
+// Check returns an error when the image is not ready to serve runs. Images
+// without a state, e.g. from image_allowlist, are not checked.
+func (tracker *ImageTracker) Check(image string) error {
+	entry := tracker.Get(image)
+	if entry == nil {
+		return nil
+	}
+
+	switch entry.State {
+	case "pulling":
+		return fmt.Errorf("Image %s is being pulled, try again later", image)
+	case "building":
+		return fmt.Errorf("Image %s is being built, try again later", image)
+	case "failed":
+		return fmt.Errorf("Image %s is not available: %s", image, entry.Error)
+	}
+
+	return nil
+}
+
+// Pending reports whether the image is being pulled or built
+func (tracker *ImageTracker) Pending(image string) bool {
+	entry := tracker.Get(image)
+	return entry != nil && (entry.State == "pulling" || entry.State == "building")
+}
+
+func newPullProgress(image string) *pullProgress {
+	return &pullProgress{
+		Image:  image,
+		layers: map[string]*pullLayer{},
+	}
+}
+
+func (progress *pullProgress) Write(data []byte) (int, error) {
+	progress.buff = append(progress.buff, data...)
+
+	for {
+		i := bytes.IndexByte(progress.buff, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimSpace(progress.buff[:i])
+		progress.buff = progress.buff[i+1:]
+
+		if len(line) > 0 {
+			progress.handle(line)
+		}
+	}
+
+	return len(data), nil
+}
+
+func (progress *pullProgress) handle(line []byte) {
+	msg := pullMessage{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+
+	// Raw stream is not checked for errors by the docker client
+	if msg.Error != "" {
+		progress.err = fmt.Errorf("%s", msg.Error)
+		return
+	}
+
+	if msg.Id != "" && msg.ProgressDetail.Total > 0 {
+		progress.layers[msg.Id] = &pullLayer{
+			Current: msg.ProgressDetail.Current,
+			Total:   msg.ProgressDetail.Total,
+		}
+	}
+
+	var current, total int64
+	for _, layer := range progress.layers {
+		current += layer.Current
+		total += layer.Total
+	}
+
+	status := msg.Status
+	if msg.Id != "" {
+		status = msg.Id + ": " + status
+	}
+
+	imageTracker.Progress(progress.Image, status, current, total)
+}
+
+// pullImages pulls images in background, at most maxConcurrentPulls at once
+func pullImages(client *docker.Client, config *Config, images []string) {
+	slots := make(chan bool, maxConcurrentPulls)
+
+	for _, image := range images {
+		slots <- true
+
+		go func(image string) {
+			defer func() { <-slots }()
+
+			policy := config.ImagePullPolicy(image)
+			ts := time.Now()
+
+			if err := pullImage(client, config, image); err != nil {
+				logger.Error("cant pull image", "image", image, "error", err)
+
+				// Images pulled again with always policy keep serving the local copy
+				if entry := imageTracker.Get(image); entry == nil || entry.State != "ready" {
+					imageTracker.Set(image, policy, "failed", err)
+				}
+				return
+			}
+
+			imageTracker.Set(image, policy, "ready", nil)
+			logger.Info("image pulled", "image", image, "digest", ImageDigest(client, image), "duration", time.Since(ts))
+		}(image)
+	}
+}
+
+// checkImageAvailable responds with 503 when the image is not ready, clients
+// are asked to retry while it is being pulled or built
+func checkImageAvailable(c *gin.Context, image string) bool {
+	if err := imageTracker.Check(image); err != nil {
+		if imageTracker.Pending(image) {
+			c.Header("Retry-After", strconv.Itoa(pullRetryAfter))
+		}
+
+		errorResponse(503, err, c)
+		return false
+	}
+
+	return true
+}
+
+func HandleImages(c *gin.Context) {
+	c.JSON(200, imageTracker.List())
+}
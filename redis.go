@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal client for the Redis protocol (RESP2), only what the throttle
+// backend needs
+
+type RedisError string
+
+func (err RedisError) Error() string {
+	return string(err)
+}
+
+// redisStatus is a simple string reply, such as OK or QUEUED
+type redisStatus string
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type RedisClient struct {
+	Address  string
+	Password string
+	DB       int
+	Timeout  time.Duration
+	pool     chan *redisConn
+}
+
+func NewRedisClient(address string, password string, db int) *RedisClient {
+	return &RedisClient{
+		Address:  address,
+		Password: password,
+		DB:       db,
+		Timeout:  time.Second * 2,
+		pool:     make(chan *redisConn, 16),
+	}
+}
+
+func writeCommand(w io.Writer, args ...string) error {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("Invalid redis protocol line")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readReply returns string, redisStatus, int64, []interface{}, nil or RedisError
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Invalid redis protocol line")
+	}
+
+	switch line[0] {
+	case '+':
+		return redisStatus(line[1:]), nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("Invalid redis reply type: %q", line[0])
+}
+
+// Do sends a command and returns its reply. Redis errors are returned as
+// RedisError and leave the connection usable.
+func (c *redisConn) Do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := writeCommand(c.conn, args...); err != nil {
+		return nil, err
+	}
+
+	reply, err := readReply(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if rerr, ok := reply.(RedisError); ok {
+		return nil, rerr
+	}
+
+	return reply, nil
+}
+
+func (client *RedisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", client.Address, client.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if client.Password != "" {
+		if _, err := rc.Do(client.Timeout, "AUTH", client.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if client.DB != 0 {
+		if _, err := rc.Do(client.Timeout, "SELECT", strconv.Itoa(client.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// reset discards an open transaction and unwatches keys
+func (c *redisConn) reset(timeout time.Duration) error {
+	// DISCARD fails outside of a transaction, which is fine
+	if _, err := c.Do(timeout, "DISCARD"); err != nil {
+		if _, ok := err.(RedisError); !ok {
+			return err
+		}
+	}
+
+	_, err := c.Do(timeout, "UNWATCH")
+	return err
+}
+
+// With runs fn on a pooled connection. Connections are discarded after
+// network errors and reset after redis errors, fn could fail in the middle
+// of a transaction.
+func (client *RedisClient) With(fn func(conn *redisConn) error) error {
+	var conn *redisConn
+
+	select {
+	case conn = <-client.pool:
+	default:
+		var err error
+		if conn, err = client.dial(); err != nil {
+			return err
+		}
+	}
+
+	err := fn(conn)
+
+	if _, ok := err.(RedisError); err != nil && !ok {
+		conn.conn.Close()
+		return err
+	}
+
+	if err != nil {
+		if resetErr := conn.reset(client.Timeout); resetErr != nil {
+			conn.conn.Close()
+			return err
+		}
+	}
+
+	select {
+	case client.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+
+	return err
+}
+
+func (client *RedisClient) Do(args ...string) (interface{}, error) {
+	var reply interface{}
+
+	err := client.With(func(conn *redisConn) error {
+		var err error
+		reply, err = conn.Do(client.Timeout, args...)
+		return err
+	})
+
+	return reply, err
+}
+
+// RedisThrottleBackend shares buckets between API instances. Buckets are
+// updated with optimistic transactions (WATCH/MULTI/EXEC) using Redis server
+// time, so instance clocks do not need to be in sync.
+type RedisThrottleBackend struct {
+	Client *RedisClient
+	Prefix string
+	// How long concurrency counters survive without updates, protects
+	// against counters left behind by crashed instances
+	ActiveTTL time.Duration
+}
+
+func NewRedisThrottleBackend(client *RedisClient, prefix string) *RedisThrottleBackend {
+	return &RedisThrottleBackend{
+		Client:    client,
+		Prefix:    prefix,
+		ActiveTTL: time.Minute * 10,
+	}
+}
+
+func redisTime(conn *redisConn, timeout time.Duration) (time.Time, error) {
+	reply, err := conn.Do(timeout, "TIME")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return time.Time{}, fmt.Errorf("Invalid TIME reply")
+	}
+
+	sec, _ := strconv.ParseInt(fmt.Sprint(items[0]), 10, 64)
+	usec, _ := strconv.ParseInt(fmt.Sprint(items[1]), 10, 64)
+
+	return time.Unix(sec, usec*1000), nil
+}
+
+func parseBucketState(val interface{}) (float64, time.Time, bool) {
+	str, ok := val.(string)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	chunks := strings.Split(str, ":")
+	if len(chunks) != 2 {
+		return 0, time.Time{}, false
+	}
+
+	tokens, err := strconv.ParseFloat(chunks[0], 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	usec, err := strconv.ParseInt(chunks[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	return tokens, time.Unix(0, usec*1000), true
+}
+
+func (r *RedisThrottleBackend) Take(id string, limits ThrottleLimits) (*ThrottleStatus, error) {
+	bucketKey := r.Prefix + "bucket:" + id
+	activeKey := r.Prefix + "active:" + id
+	timeout := r.Client.Timeout
+
+	var status *ThrottleStatus
+	var rejected error
+
+	err := r.Client.With(func(conn *redisConn) error {
+		for attempt := 0; attempt < 10; attempt++ {
+			if _, err := conn.Do(timeout, "WATCH", bucketKey, activeKey); err != nil {
+				return err
+			}
+
+			now, err := redisTime(conn, timeout)
+			if err != nil {
+				return err
+			}
+
+			reply, err := conn.Do(timeout, "MGET", bucketKey, activeKey)
+			if err != nil {
+				return err
+			}
+
+			values, _ := reply.([]interface{})
+			if len(values) != 2 {
+				return fmt.Errorf("Invalid MGET reply")
+			}
+
+			tokens := limits.capacity()
+			if prevTokens, updated, ok := parseBucketState(values[0]); ok {
+				tokens = limits.refill(prevTokens, now.Sub(updated))
+			}
+
+			active := 0
+			if str, ok := values[1].(string); ok {
+				active, _ = strconv.Atoi(str)
+			}
+
+			if limits.Concurrency > 0 && active >= limits.Concurrency {
+				status = limits.status(tokens)
+				status.RetryAfter = time.Second
+				rejected = errTooManyConcurrent
+				_, err := conn.Do(timeout, "UNWATCH")
+				return err
+			}
+
+			if tokens < 1 {
+				status = limits.status(tokens)
+				rejected = errTooManyRequests
+				_, err := conn.Do(timeout, "UNWATCH")
+				return err
+			}
+
+			tokens--
+
+			// Bucket could be dropped once it is full again
+			ttl := time.Duration(limits.capacity()/limits.rate()*float64(time.Second)) + time.Second
+			state := fmt.Sprintf("%s:%d", strconv.FormatFloat(tokens, 'f', -1, 64), now.UnixNano()/1000)
+
+			commands := [][]string{
+				{"MULTI"},
+				{"SET", bucketKey, state, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10)},
+				{"INCR", activeKey},
+				{"PEXPIRE", activeKey, strconv.FormatInt(int64(r.ActiveTTL/time.Millisecond), 10)},
+			}
+
+			for _, cmd := range commands {
+				if _, err := conn.Do(timeout, cmd...); err != nil {
+					return err
+				}
+			}
+
+			reply, err = conn.Do(timeout, "EXEC")
+			if err != nil {
+				return err
+			}
+
+			// Transaction is aborted when another instance changed the bucket,
+			// back off a little to let it through
+			if reply == nil {
+				time.Sleep(time.Duration(rand.Intn(5*(attempt+1))+1) * time.Millisecond)
+				continue
+			}
+
+			status = limits.status(tokens)
+			return nil
+		}
+
+		return fmt.Errorf("Throttle state is too contended")
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return status, rejected
+}
+
+func (r *RedisThrottleBackend) Release(id string) error {
+	activeKey := r.Prefix + "active:" + id
+
+	reply, err := r.Client.Do("DECR", activeKey)
+	if err != nil {
+		return err
+	}
+
+	// Counter expired while the request was running
+	if n, ok := reply.(int64); ok && n < 0 {
+		_, err = r.Client.Do("INCRBY", activeKey, strconv.FormatInt(-n, 10))
+	}
+
+	return err
+}
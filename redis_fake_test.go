@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeRedis is an in-process server implementing the subset of the Redis
+// protocol used by RedisThrottleBackend. It allows running several throttlers
+// against shared state without a real Redis server, e.g. in tests.
+type FakeRedis struct {
+	Address  string
+	listener net.Listener
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]uint64
+	sync.Mutex
+}
+
+type fakeRedisSession struct {
+	watched map[string]uint64
+	queue   [][]string
+	multi   bool
+}
+
+func NewFakeRedis() (*FakeRedis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	fake := &FakeRedis{
+		Address:  listener.Addr().String(),
+		listener: listener,
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+		versions: map[string]uint64{},
+	}
+
+	go fake.serve()
+	return fake, nil
+}
+
+func (f *FakeRedis) Close() error {
+	return f.listener.Close()
+}
+
+func (f *FakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func writeReply(w io.Writer, reply interface{}) {
+	switch val := reply.(type) {
+	case nil:
+		io.WriteString(w, "$-1\r\n")
+	case redisStatus:
+		fmt.Fprintf(w, "+%s\r\n", val)
+	case RedisError:
+		fmt.Fprintf(w, "-%s\r\n", val)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", val)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(val), val)
+	case []interface{}:
+		if val == nil {
+			io.WriteString(w, "*-1\r\n")
+			return
+		}
+
+		fmt.Fprintf(w, "*%d\r\n", len(val))
+		for _, item := range val {
+			writeReply(w, item)
+		}
+	}
+}
+
+func (f *FakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	session := &fakeRedisSession{watched: map[string]uint64{}}
+
+	for {
+		request, err := readReply(reader)
+		if err != nil {
+			return
+		}
+
+		items, ok := request.([]interface{})
+		if !ok || len(items) == 0 {
+			writeReply(writer, RedisError("ERR invalid request"))
+			writer.Flush()
+			continue
+		}
+
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = fmt.Sprint(item)
+		}
+
+		writeReply(writer, f.dispatch(session, args))
+		writer.Flush()
+	}
+}
+
+func (f *FakeRedis) dispatch(session *fakeRedisSession, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch cmd {
+	case "MULTI":
+		session.multi = true
+		session.queue = nil
+		return redisStatus("OK")
+	case "DISCARD":
+		session.multi = false
+		session.queue = nil
+		session.watched = map[string]uint64{}
+		return redisStatus("OK")
+	case "EXEC":
+		return f.exec(session)
+	case "WATCH":
+		for _, key := range args[1:] {
+			f.expire(key)
+			session.watched[key] = f.versions[key]
+		}
+		return redisStatus("OK")
+	case "UNWATCH":
+		session.watched = map[string]uint64{}
+		return redisStatus("OK")
+	}
+
+	if session.multi {
+		session.queue = append(session.queue, args)
+		return redisStatus("QUEUED")
+	}
+
+	return f.execute(args)
+}
+
+func (f *FakeRedis) exec(session *fakeRedisSession) interface{} {
+	defer func() {
+		session.multi = false
+		session.queue = nil
+		session.watched = map[string]uint64{}
+	}()
+
+	if !session.multi {
+		return RedisError("ERR EXEC without MULTI")
+	}
+
+	for key, version := range session.watched {
+		f.expire(key)
+		if f.versions[key] != version {
+			return []interface{}(nil)
+		}
+	}
+
+	replies := []interface{}{}
+	for _, args := range session.queue {
+		replies = append(replies, f.execute(args))
+	}
+
+	return replies
+}
+
+// expire drops the key if its ttl has passed, caller must hold the lock
+func (f *FakeRedis) expire(key string) {
+	if ts, ok := f.expires[key]; ok && time.Now().After(ts) {
+		f.delete(key)
+	}
+}
+
+func (f *FakeRedis) delete(key string) {
+	delete(f.values, key)
+	delete(f.expires, key)
+	f.versions[key]++
+}
+
+func (f *FakeRedis) set(key string, val string) {
+	f.values[key] = val
+	f.versions[key]++
+}
+
+func (f *FakeRedis) incrBy(key string, delta int64) interface{} {
+	f.expire(key)
+
+	current := int64(0)
+	if val, ok := f.values[key]; ok {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return RedisError("ERR value is not an integer or out of range")
+		}
+		current = n
+	}
+
+	current += delta
+	f.set(key, strconv.FormatInt(current, 10))
+
+	return current
+}
+
+// execute runs a single data command, caller must hold the lock
+func (f *FakeRedis) execute(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+
+	wrongArgs := RedisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+
+	switch cmd {
+	case "PING":
+		return redisStatus("PONG")
+	case "AUTH", "SELECT":
+		return redisStatus("OK")
+	case "TIME":
+		now := time.Now()
+		return []interface{}{
+			strconv.FormatInt(now.Unix(), 10),
+			strconv.FormatInt(int64(now.Nanosecond()/1000), 10),
+		}
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+
+		f.expire(args[1])
+		if val, ok := f.values[args[1]]; ok {
+			return val
+		}
+		return nil
+	case "MGET":
+		result := []interface{}{}
+		for _, key := range args[1:] {
+			f.expire(key)
+			if val, ok := f.values[key]; ok {
+				result = append(result, val)
+			} else {
+				result = append(result, nil)
+			}
+		}
+		return result
+	case "SET":
+		if len(args) != 3 && len(args) != 5 {
+			return wrongArgs
+		}
+
+		f.set(args[1], args[2])
+		delete(f.expires, args[1])
+
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return RedisError("ERR value is not an integer or out of range")
+			}
+			f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return redisStatus("OK")
+	case "DEL":
+		count := int64(0)
+		for _, key := range args[1:] {
+			f.expire(key)
+			if _, ok := f.values[key]; ok {
+				f.delete(key)
+				count++
+			}
+		}
+		return count
+	case "INCR", "DECR":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+
+		if cmd == "DECR" {
+			return f.incrBy(args[1], -1)
+		}
+		return f.incrBy(args[1], 1)
+	case "INCRBY":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return RedisError("ERR value is not an integer or out of range")
+		}
+		return f.incrBy(args[1], delta)
+	case "PEXPIRE":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return RedisError("ERR value is not an integer or out of range")
+		}
+
+		f.expire(args[1])
+		if _, ok := f.values[args[1]]; !ok {
+			return int64(0)
+		}
+
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	}
+
+	return RedisError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newSharedThrottlers returns two throttlers with their own redis clients
+// sharing state in one fake server, as two api instances would
+func newSharedThrottlers(t *testing.T, limits ThrottleLimits) (*Throttler, *Throttler) {
+	fake, err := NewFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+
+	first := NewThrottler(limits, NewRedisThrottleBackend(NewRedisClient(fake.Address, "", 0), "bitrun:"))
+	second := NewThrottler(limits, NewRedisThrottleBackend(NewRedisClient(fake.Address, "", 0), "bitrun:"))
+
+	return first, second
+}
+
+func TestRedisThrottlerSharedQuota(t *testing.T) {
+	limits := ThrottleLimits{Quota: 3, Window: time.Hour}
+	first, second := newSharedThrottlers(t, limits)
+
+	steps := []struct {
+		throttler *Throttler
+		remaining int
+		err       error
+	}{
+		{first, 2, nil},
+		{second, 1, nil},
+		{first, 0, nil},
+		{second, 0, errTooManyRequests},
+		{first, 0, errTooManyRequests},
+	}
+
+	for i, step := range steps {
+		status, err := step.throttler.Add("1.2.3.4", limits)
+		if err != step.err {
+			t.Fatalf("request %d: expected error %v, got %v", i+1, step.err, err)
+		}
+
+		if err == nil {
+			step.throttler.Remove("1.2.3.4")
+		}
+
+		if status.Remaining != step.remaining {
+			t.Errorf("request %d: expected %d remaining, got %d", i+1, step.remaining, status.Remaining)
+		}
+	}
+
+	if _, err := second.Add("5.6.7.8", limits); err != nil {
+		t.Errorf("expected separate quota for another client, got %v", err)
+	}
+}
+
+func TestRedisThrottlerSharedConcurrency(t *testing.T) {
+	limits := ThrottleLimits{Quota: 100, Window: time.Hour, Concurrency: 1}
+	first, second := newSharedThrottlers(t, limits)
+
+	if _, err := first.Add("1.2.3.4", limits); err != nil {
+		t.Fatalf("expected first request to pass, got %v", err)
+	}
+
+	if _, err := second.Add("1.2.3.4", limits); err != errTooManyConcurrent {
+		t.Fatalf("expected %v on other instance, got %v", errTooManyConcurrent, err)
+	}
+
+	first.Remove("1.2.3.4")
+
+	if _, err := second.Add("1.2.3.4", limits); err != nil {
+		t.Fatalf("expected request to pass after release, got %v", err)
+	}
+
+	if _, err := first.Add("1.2.3.4", limits); err != errTooManyConcurrent {
+		t.Fatalf("expected %v on first instance, got %v", errTooManyConcurrent, err)
+	}
+}
+
+func TestRedisClientResetsConnection(t *testing.T) {
+	fake, err := NewFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	client := NewRedisClient(fake.Address, "", 0)
+	other := NewRedisClient(fake.Address, "", 0)
+
+	// Caller fails in the middle of a transaction with watched keys
+	err = client.With(func(conn *redisConn) error {
+		if _, err := conn.Do(client.Timeout, "WATCH", "key"); err != nil {
+			return err
+		}
+
+		if _, err := conn.Do(client.Timeout, "MULTI"); err != nil {
+			return err
+		}
+
+		return RedisError("ERR failed")
+	})
+	if _, ok := err.(RedisError); !ok {
+		t.Fatalf("expected redis error, got %v", err)
+	}
+
+	if _, err := other.Do("SET", "key", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Next caller gets the pooled connection outside of the transaction
+	if reply, err := client.Do("GET", "key"); err != nil || reply != "1" {
+		t.Fatalf("expected command to run right away, got %v %v", reply, err)
+	}
+
+	var reply interface{}
+	err = client.With(func(conn *redisConn) error {
+		if _, err := conn.Do(client.Timeout, "MULTI"); err != nil {
+			return err
+		}
+
+		if _, err := conn.Do(client.Timeout, "SET", "key", "2"); err != nil {
+			return err
+		}
+
+		reply, err = conn.Do(client.Timeout, "EXEC")
+		return err
+	})
+
+	if err != nil || reply == nil {
+		t.Errorf("expected transaction not to be aborted by a stale watch, got %v %v", reply, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var reloadMutex sync.Mutex
+
+// Reload re-reads config and languages files and applies them without
+// interrupting in-flight runs. Nothing is swapped unless all checks pass.
+func Reload(client *docker.Client) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	current := CurrentConfig()
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// These settings are bound to the running server and existing containers
+	if config.Listen != current.Listen || config.DockerHost != current.DockerHost || config.SharedPath != current.SharedPath {
+		logger.Warn("listen, docker_host and shared_path changes require a restart, ignoring")
+		config.Listen = current.Listen
+		config.DockerHost = current.DockerHost
+		config.SharedPath = current.SharedPath
+	}
+
+	langs, err := ParseLanguages(config.LanguagesPath)
+	if err != nil {
+		return err
+	}
+
+	knownImages := map[string]bool{}
+	for _, lang := range GetLanguages() {
+		for _, image := range lang.Images() {
+			knownImages[image] = true
+		}
+	}
+
+	// Failed images are checked again as well
+	newLangs := map[string]Language{}
+	for ext, lang := range langs {
+		for _, image := range lang.Images() {
+			entry := imageTracker.Get(image)
+			if !knownImages[image] || (entry != nil && entry.State == "failed") {
+				newLangs[ext] = lang
+				break
+			}
+		}
+	}
+
+	if config.KeysPath != current.KeysPath {
+		logger.Warn("keys_path changes require a restart, ignoring")
+		config.KeysPath = current.KeysPath
+	}
+
+	if config.Namespaces != current.Namespaces || namespacesPath(config) != namespacesPath(current) {
+		logger.Warn("namespaces and namespaces_path changes require a restart, ignoring")
+		config.Namespaces = current.Namespaces
+		config.NamespacesPath = current.NamespacesPath
+	}
+
+	if artifactsPath(config) != artifactsPath(current) {
+		logger.Warn("artifacts_path changes require a restart, ignoring")
+		config.ArtifactsPath = current.ArtifactsPath
+	}
+
+	if config.Deps != current.Deps || depsPath(config) != depsPath(current) {
+		logger.Warn("deps and deps_path changes require a restart, ignoring")
+		config.Deps = current.Deps
+		config.DepsPath = current.DepsPath
+	}
+
+	if snippetsPath(config) != snippetsPath(current) {
+		logger.Warn("snippets_path changes require a restart, ignoring")
+		config.SnippetsPath = current.SnippetsPath
+	}
+
+	if config.HistoryBackend != current.HistoryBackend || config.HistoryPath != current.HistoryPath ||
+		config.HistoryMaxAge != current.HistoryMaxAge || config.HistoryMaxRecords != current.HistoryMaxRecords {
+		logger.Warn("run history changes require a restart, ignoring")
+		config.HistoryBackend = current.HistoryBackend
+		config.HistoryPath = current.HistoryPath
+		config.HistoryMaxAge = current.HistoryMaxAge
+		config.HistoryMaxRecords = current.HistoryMaxRecords
+	}
+
+	if config.ThrottleBackend != current.ThrottleBackend || config.RedisAddress != current.RedisAddress ||
+		config.RedisPassword != current.RedisPassword || config.RedisDB != current.RedisDB || config.RedisPrefix != current.RedisPrefix {
+		logger.Warn("throttle_backend and redis changes require a restart, ignoring")
+		config.ThrottleBackend = current.ThrottleBackend
+		config.RedisAddress = current.RedisAddress
+		config.RedisPassword = current.RedisPassword
+		config.RedisDB = current.RedisDB
+		config.RedisPrefix = current.RedisPrefix
+	}
+
+	if config.Sessions != current.Sessions {
+		logger.Warn("sessions changes require a restart, ignoring")
+		config.Sessions = current.Sessions
+	}
+
+	if keyStore != nil {
+		if err := keyStore.Load(); err != nil {
+			return err
+		}
+	}
+
+	verifier, err := NewJwtVerifier(config)
+	if err != nil {
+		return err
+	}
+
+	if err := checkImages(client, config, newLangs); err != nil {
+		return err
+	}
+
+	if err := ReconcilePools(config, client); err != nil {
+		return err
+	}
+
+	SetLanguages(langs)
+	SetCurrentConfig(config)
+	setJwtVerifier(verifier)
+	logLevel.Set(logLevels[config.LogLevel])
+
+	if apiThrottler != nil {
+		apiThrottler.Configure(config)
+		apiThrottler.SetWhitelist(config.ThrottleWhitelist)
+	}
+
+	if namespaceStore != nil {
+		namespaceStore.Configure(config)
+	}
+
+	StartImageRefresh(client, config)
+
+	// Images are built once the configuration is swapped, languages with
+	// missing images are unavailable until their builds finish. Changed build
+	// definitions rebuild images of known languages as well.
+	go imageBuilder.BuildAll(langs, false)
+
+	logger.Info("configuration reloaded", "languages", len(langs))
+	return nil
+}
+
+func watchReloadSignal(client *docker.Client) {
+	chSignals := make(chan os.Signal, 1)
+	signal.Notify(chSignals, syscall.SIGHUP)
+
+	for range chSignals {
+		logger.Info("got SIGHUP, reloading configuration")
+
+		if err := Reload(client); err != nil {
+			logger.Error("reload failed", "error", err)
+		}
+	}
+}
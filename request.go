@@ -8,23 +8,40 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Request struct {
-	Filename    string
-	Content     string
-	CacheKey    string
-	Command     string
-	Input       string
-	Image       string
-	Format      string
-	MemoryLimit int64
-	NamespaceId string
-	Env         string
-	Clean       bool
+	Filename        string
+	Language        string
+	Version         string
+	Content         string
+	CacheKey        string
+	Command         string
+	Input           string
+	Image           string
+	Format          string
+	MemoryLimit     int64
+	Timeout         time.Duration
+	NamespaceId     string
+	Env             string
+	Clean           bool
+	Artifacts       []string
+	ArtifactsFormat string
+	Share           bool
+	Manifest        string
+	Deps            *Dependencies
 }
 
-var FilenameRegexp = regexp.MustCompile(`\A([a-z\d\-\_]+)\.[a-z]{1,12}\z`)
+// Filenames could have multiple or no extensions, e.g. main.test.js or Makefile
+var FilenameRegexp = regexp.MustCompile(`\A[\w\-]+(\.[\w\-]+)*\z`)
+
+// Maximum length of a filename
+const maxFilenameLength = 128
+
+func validFilename(name string) bool {
+	return len(name) <= maxFilenameLength && FilenameRegexp.MatchString(name)
+}
 
 func normalizeString(val string) string {
 	return strings.ToLower(strings.TrimSpace(val))
@@ -55,14 +72,17 @@ func sha1Sum(input string) string {
 
 func ParseRequest(r *http.Request) (*Request, error) {
 	req := Request{
-		Filename:    normalizeString(r.FormValue("filename")),
+		Filename:    strings.TrimSpace(r.FormValue("filename")),
+		Language:    normalizeString(r.FormValue("language")),
 		Command:     normalizeString(r.FormValue("command")),
 		Content:     r.FormValue("content"),
 		Input:       r.FormValue("input"),
-		Image:       r.FormValue("image"),
+		Image:       strings.TrimSpace(r.FormValue("image")),
+		Version:     normalizeString(r.FormValue("version")),
 		MemoryLimit: parseInt(r.FormValue("memory_limit")),
 		NamespaceId: normalizeString(r.FormValue("namespace")),
 		Env:         strings.TrimSpace(r.FormValue("env")),
+		Manifest:    r.FormValue("manifest"),
 		Clean:       false,
 	}
 
@@ -70,35 +90,94 @@ func ParseRequest(r *http.Request) (*Request, error) {
 		req.Clean = true
 	}
 
+	if r.FormValue("share") == "1" {
+		req.Share = true
+	}
+
+	artifacts, err := parseArtifactPatterns(r.Form["artifacts"])
+	if err != nil {
+		return nil, err
+	}
+
+	req.Artifacts = artifacts
+	req.ArtifactsFormat = normalizeString(r.FormValue("artifacts_format"))
+
+	if req.ArtifactsFormat == "" {
+		req.ArtifactsFormat = "json"
+	}
+
+	if !validArtifactsFormat(req.ArtifactsFormat) {
+		return nil, fmt.Errorf("Artifacts format must be json, multipart or store")
+	}
+
+	if err := req.resolve(); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// resolve validates the file and fills in language defaults and cache key.
+// Language set before resolving is used instead of detection.
+func (req *Request) resolve() error {
 	if req.Filename == "" {
-		return nil, fmt.Errorf("Filename is required")
+		return fmt.Errorf("Filename is required")
 	}
 
-	if !FilenameRegexp.Match([]byte(req.Filename)) {
-		return nil, fmt.Errorf("Invalid filename")
+	if !validFilename(req.Filename) {
+		return fmt.Errorf("Invalid filename")
 	}
 
 	if req.Content == "" {
-		return nil, fmt.Errorf("Content is required")
+		return fmt.Errorf("Content is required")
 	}
 
-	lang, err := GetLanguageConfig(req.Filename)
+	_, lang, err := DetectLanguage(req.Filename, req.Content, req.Language)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	version, err := lang.Version(req.Version)
+	if err != nil {
+		return err
 	}
 
 	req.Format = lang.Format
+	req.Language = lang.Name
+	req.Version = version.Name
 
 	if req.Image == "" {
-		req.Image = lang.Image
+		req.Image = version.Image
+	} else if !ImageAllowed(CurrentConfig(), req.Image) {
+		return fmt.Errorf("Image is not allowed: %s", req.Image)
 	}
 
 	if req.Command == "" {
-		req.Command = fmt.Sprintf(lang.Command, req.Filename)
+		req.Command = fmt.Sprintf(version.Command, req.Filename)
 	}
 
-	// Calculate request cache key based on content, command and image
-	req.CacheKey = sha1Sum(req.Content + req.Input + req.Command + req.Image)
+	if req.Manifest != "" {
+		if depsCache == nil {
+			return fmt.Errorf("Dependencies are not enabled")
+		}
 
-	return &req, nil
+		if version.Dependencies == nil {
+			return fmt.Errorf("Dependencies are not supported for %s", version.Name)
+		}
+
+		if len(req.Manifest) > maxManifestSize {
+			return fmt.Errorf("Manifest exceeds %d bytes", maxManifestSize)
+		}
+
+		if req.Filename == version.Dependencies.Manifest {
+			return fmt.Errorf("Filename conflicts with the manifest")
+		}
+
+		req.Deps = version.Dependencies
+	}
+
+	// Calculate request cache key based on content, command, image and manifest
+	req.CacheKey = sha1Sum(req.Content + req.Input + req.Command + req.Image + req.Manifest)
+
+	return nil
 }
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
+	"regexp"
+	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -17,12 +20,32 @@ type Run struct {
 	Client     *docker.Client
 	Request    *Request
 	Done       chan bool
+	ClientIP   string
+	Trace      *Trace
+	Namespace  *Namespace
+	SessionId  string
+	// Extra settings of containers created for the run
+	ContainerOptions ContainerOptions
+	log              *slog.Logger
+	sync.Mutex
 }
 
+var RunIdRegexp = regexp.MustCompile(`\A[a-f\d]{40}\z`)
+
 type RunResult struct {
 	ExitCode int    `json:"exit_code"`
 	Output   []byte `json:"output"`
 	Duration string `json:"-"`
+	// Digest of the image the run was served by
+	ImageDigest string `json:"-"`
+}
+
+type TimeoutError struct {
+	Duration time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("Operation timed out after %s", err.Duration.String())
 }
 
 type Done struct {
@@ -30,7 +53,7 @@ type Done struct {
 	error
 }
 
-func NewRun(config *Config, client *docker.Client, req *Request) *Run {
+func NewRun(config *Config, client *docker.Client, req *Request, clientIP string) *Run {
 	id, _ := randomHex(20)
 
 	return &Run{
@@ -40,29 +63,106 @@ func NewRun(config *Config, client *docker.Client, req *Request) *Run {
 		VolumePath: fmt.Sprintf("%s/%s", config.SharedPath, id),
 		Request:    req,
 		Done:       make(chan bool),
+		ClientIP:   clientIP,
+		log: logger.With(
+			"run_id", id,
+			"image", req.Image,
+			"language", req.Language,
+			"client_ip", clientIP,
+			"namespace", req.NamespaceId,
+		),
 	}
 }
 
+// Log returns a logger annotated with the run and container details
+func (run *Run) Log() *slog.Logger {
+	run.Lock()
+	defer run.Unlock()
+
+	return run.log
+}
+
 func (run *Run) Setup() error {
-	container, err := CreateContainer(run.Client, run.Config, run.Request.Image, 60, run.Request.Env)
+	span := run.Trace.StartSpan("create_container")
+	options := run.ContainerOptions
+	if run.Namespace != nil {
+		options.CodePath = run.Namespace.Path
+	}
+
+	container, err := CreateContainer(run.Client, run.Config, run.Request.Image, run.Standby(), run.Request.Env, run.MemoryLimit(), options)
+	span.Finish(err)
+
 	if err != nil {
 		return err
 	}
 
-	volumePath := fmt.Sprintf("%s/%s", run.Config.SharedPath, container.Config.Labels["id"])
-	fullPath := fmt.Sprintf("%s/%s", volumePath, run.Request.Filename)
+	run.setContainer(container)
+	span.SetAttribute("container_id", container.ID)
 
-	if err := ioutil.WriteFile(fullPath, []byte(run.Request.Content), 0666); err != nil {
+	if err := run.writeFile(); err != nil {
 		return err
 	}
 
-	run.Container = container
+	span = run.Trace.StartSpan("start_container")
+	ts := time.Now()
+	err = run.Client.StartContainer(container.ID, nil)
+	observeDocker("start_container", ts, err)
+	span.Finish(err)
 
-	if err := run.Client.StartContainer(container.ID, nil); err != nil {
-		return err
+	return err
+}
+
+func (run *Run) writeFile() error {
+	// Commands could be run without a file in sessions
+	if run.Request.Filename == "" {
+		return nil
+	}
+
+	span := run.Trace.StartSpan("write_file")
+
+	err := run.writeCodeFile(run.Request.Filename, run.Request.Content)
+
+	// Dependency manifest is needed by some languages at run time as well
+	if err == nil && run.Request.Manifest != "" {
+		err = run.writeCodeFile(run.Request.Deps.Manifest, run.Request.Manifest)
+	}
+	span.Finish(err)
+
+	return err
+}
+
+func (run *Run) writeCodeFile(name string, content string) error {
+	if run.Namespace != nil {
+		return run.Namespace.WriteFile(name, []byte(content))
 	}
 
-	return nil
+	return ioutil.WriteFile(fmt.Sprintf("%s/%s", run.VolumePath, name), []byte(content), 0666)
+}
+
+// Timeout returns the run duration limit, requests could only lower it
+func (run *Run) Timeout() time.Duration {
+	if run.Request.Timeout > 0 && run.Request.Timeout < run.Config.RunDuration {
+		return run.Request.Timeout
+	}
+
+	return run.Config.RunDuration
+}
+
+// Standby returns how long the run container stays up, in seconds. It must
+// outlive the timeout, otherwise the container exits before the timeout fires.
+func (run *Run) Standby() int {
+	return int(run.Timeout().Seconds()) + 60
+}
+
+// MemoryLimit returns the container memory limit, requests could only lower it
+func (run *Run) MemoryLimit() int64 {
+	limit := run.Config.MemoryLimit
+
+	if run.Request.MemoryLimit > 0 && (limit == 0 || run.Request.MemoryLimit < limit) {
+		return run.Request.MemoryLimit
+	}
+
+	return limit
 }
 
 func (run *Run) Start() (*RunResult, error) {
@@ -70,7 +170,7 @@ func (run *Run) Start() (*RunResult, error) {
 }
 
 func (run *Run) StartWithTimeout() (*RunResult, error) {
-	duration := run.Config.RunDuration
+	duration := run.Timeout()
 	timeout := time.After(duration)
 	chDone := make(chan Done)
 
@@ -83,22 +183,54 @@ func (run *Run) StartWithTimeout() (*RunResult, error) {
 	case done := <-chDone:
 		return done.RunResult, done.error
 	case <-timeout:
-		return nil, fmt.Errorf("Operation timed out after %s", duration.String())
+		return nil, &TimeoutError{duration}
 	}
 }
 
+func (run *Run) setContainer(container *docker.Container) {
+	run.Lock()
+	defer run.Unlock()
+
+	run.Container = container
+	run.log = run.log.With("container_id", container.ID)
+	run.VolumePath = fmt.Sprintf("%s/%s", run.Config.SharedPath, container.Config.Labels["id"])
+}
+
+// ImageDigest returns the digest of the image of the run container
+func (run *Run) ImageDigest() string {
+	run.Lock()
+	defer run.Unlock()
+
+	if run.Container == nil || run.Container.Config == nil {
+		return ""
+	}
+
+	return run.Container.Config.Labels[imageDigestLabel]
+}
+
 func (run *Run) Destroy() error {
-	if run.Container != nil {
-		destroyContainer(run.Client, run.Container.ID)
+	run.Lock()
+	container, volumePath := run.Container, run.VolumePath
+	run.Unlock()
+
+	span := run.Trace.StartSpan("destroy")
+	defer span.Finish(nil)
+
+	if container != nil {
+		destroyContainer(run.Client, container.ID)
 	}
 
-	return os.RemoveAll(run.VolumePath)
+	return os.RemoveAll(volumePath)
 }
 
 func destroyContainer(client *docker.Client, id string) error {
-	return client.RemoveContainer(docker.RemoveContainerOptions{
+	ts := time.Now()
+	err := client.RemoveContainer(docker.RemoveContainerOptions{
 		ID:            id,
 		RemoveVolumes: true,
 		Force:         true,
 	})
+	observeDocker("remove_container", ts, err)
+
+	return err
 }
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	gin "github.com/gin-gonic/gin"
+)
+
+// Session is a dedicated container that keeps state between runs. Sessions
+// are closed after being idle or reaching their max lifetime.
+type Session struct {
+	Id          string
+	Owner       string
+	Language    string
+	Version     string
+	Image       string
+	Container   *docker.Container
+	VolumePath  string
+	CreatedAt   time.Time
+	LastUsedAt  time.Time
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	busy        bool
+	sync.Mutex
+}
+
+type SessionManager struct {
+	Client   *docker.Client
+	Sessions map[string]*Session
+	sync.Mutex
+}
+
+var (
+	errSessionBusy     = fmt.Errorf("Session is busy")
+	errSessionNotFound = fmt.Errorf("Session does not exist")
+	errTooManySessions = fmt.Errorf("Too many sessions")
+)
+
+var sessionManager *SessionManager
+
+func NewSessionManager(client *docker.Client) *SessionManager {
+	return &SessionManager{
+		Client:   client,
+		Sessions: map[string]*Session{},
+	}
+}
+
+// Acquire marks the session as used by a request, only one request could use
+// a session at a time
+func (session *Session) Acquire() error {
+	session.Lock()
+	defer session.Unlock()
+
+	if session.busy {
+		return errSessionBusy
+	}
+
+	session.busy = true
+	return nil
+}
+
+func (session *Session) Release() {
+	session.Lock()
+	defer session.Unlock()
+
+	session.busy = false
+	session.LastUsedAt = time.Now()
+}
+
+// Expired reports whether the session was idle or alive for too long
+func (session *Session) Expired(now time.Time) bool {
+	session.Lock()
+	defer session.Unlock()
+
+	if session.busy || session.Container == nil {
+		return now.Sub(session.CreatedAt) >= session.MaxLifetime
+	}
+
+	return now.Sub(session.LastUsedAt) >= session.IdleTimeout || now.Sub(session.CreatedAt) >= session.MaxLifetime
+}
+
+func (session *Session) Info() map[string]interface{} {
+	session.Lock()
+	defer session.Unlock()
+
+	expiresAt := session.LastUsedAt.Add(session.IdleTimeout)
+	if maxExpiresAt := session.CreatedAt.Add(session.MaxLifetime); maxExpiresAt.Before(expiresAt) {
+		expiresAt = maxExpiresAt
+	}
+
+	return map[string]interface{}{
+		"id":           session.Id,
+		"language":     session.Language,
+		"version":      session.Version,
+		"image":        session.Image,
+		"created_at":   session.CreatedAt.UTC(),
+		"last_used_at": session.LastUsedAt.UTC(),
+		"expires_at":   expiresAt.UTC(),
+	}
+}
+
+// newSession builds a busy session for the resolved request, files of the
+// session language later run with its version
+func newSession(config *Config, req *Request, owner string) *Session {
+	id, _ := randomHex(20)
+	now := time.Now()
+
+	return &Session{
+		Id:          id,
+		Owner:       owner,
+		Language:    req.Language,
+		Version:     req.Version,
+		Image:       req.Image,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		IdleTimeout: config.SessionIdleTimeout,
+		MaxLifetime: config.SessionMaxLifetime,
+		busy:        true,
+	}
+}
+
+// Create starts a session container. Sessions are counted per owner, limit
+// overrides the configured number of sessions per owner.
+func (m *SessionManager) Create(config *Config, req *Request, owner string, limit int) (*Session, error) {
+	session := newSession(config, req, owner)
+	id := session.Id
+
+	if limit <= 0 {
+		limit = config.SessionsPerKey
+	}
+
+	// Reserve a slot before creating the container, so concurrent requests
+	// could not go over the limits
+	m.Lock()
+	count := 0
+	for _, s := range m.Sessions {
+		if s.Owner == owner {
+			count++
+		}
+	}
+
+	if count >= limit || (config.MaxSessions > 0 && len(m.Sessions) >= config.MaxSessions) {
+		m.Unlock()
+		return nil, errTooManySessions
+	}
+
+	m.Sessions[id] = session
+	m.Unlock()
+
+	// Container stops by itself shortly after the session max lifetime
+	standby := int(session.MaxLifetime.Seconds()) + 60
+
+	container, err := CreateContainer(m.Client, config, req.Image, standby, req.Env, req.MemoryLimit, ContainerOptions{})
+	if err == nil {
+		ts := time.Now()
+		err = m.Client.StartContainer(container.ID, nil)
+		observeDocker("start_container", ts, err)
+	}
+
+	if err != nil {
+		m.Lock()
+		delete(m.Sessions, id)
+		m.Unlock()
+
+		if container != nil {
+			destroyContainer(m.Client, container.ID)
+			os.RemoveAll(fmt.Sprintf("%s/%s", config.SharedPath, container.Config.Labels["id"]))
+		}
+
+		return nil, err
+	}
+
+	session.Lock()
+	session.Container = container
+	session.VolumePath = fmt.Sprintf("%s/%s", config.SharedPath, container.Config.Labels["id"])
+	session.Unlock()
+
+	session.Release()
+
+	logger.Info("session created", "session_id", id, "owner", owner, "image", req.Image, "container_id", container.ID)
+	return session, nil
+}
+
+// Get returns a session if it belongs to the owner
+func (m *SessionManager) Get(id string, owner string) *Session {
+	m.Lock()
+	defer m.Unlock()
+
+	session := m.Sessions[id]
+	if session == nil || session.Owner != owner {
+		return nil
+	}
+
+	return session
+}
+
+// Close removes the session and destroys its container
+func (m *SessionManager) Close(id string) error {
+	m.Lock()
+	session := m.Sessions[id]
+	delete(m.Sessions, id)
+	m.Unlock()
+
+	if session == nil {
+		return errSessionNotFound
+	}
+
+	session.Lock()
+	container, volumePath := session.Container, session.VolumePath
+	session.Unlock()
+
+	if container != nil {
+		destroyContainer(m.Client, container.ID)
+	}
+
+	logger.Info("session closed", "session_id", id, "owner", session.Owner)
+
+	if volumePath != "" {
+		return os.RemoveAll(volumePath)
+	}
+
+	return nil
+}
+
+func (m *SessionManager) CloseAll() {
+	m.Lock()
+	ids := []string{}
+	for id := range m.Sessions {
+		ids = append(ids, id)
+	}
+	m.Unlock()
+
+	for _, id := range ids {
+		m.Close(id)
+	}
+}
+
+func (m *SessionManager) Count() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.Sessions)
+}
+
+// Cleanup closes expired sessions
+func (m *SessionManager) Cleanup() {
+	now := time.Now()
+	expired := []string{}
+
+	m.Lock()
+	for id, session := range m.Sessions {
+		if session.Expired(now) {
+			expired = append(expired, id)
+		}
+	}
+	m.Unlock()
+
+	for _, id := range expired {
+		logger.Debug("closing expired session", "session_id", id)
+		m.Close(id)
+	}
+}
+
+func (m *SessionManager) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Second * 10)
+			m.Cleanup()
+		}
+	}()
+}
+
+// sessionOwner returns the id sessions are counted and accessed by
+func sessionOwner(c *gin.Context) string {
+	if key := getApiKey(c); key != nil {
+		return "key:" + key.Id
+	}
+
+	return "ip:" + clientIP(c)
+}
+
+// ParseSessionRequest parses a run in a session. Unlike regular runs, a file
+// is optional, a plain command could be executed instead.
+func ParseSessionRequest(r *http.Request, session *Session) (*Request, error) {
+	req := Request{
+		Filename: strings.TrimSpace(r.FormValue("filename")),
+		Command:  normalizeString(r.FormValue("command")),
+		Content:  r.FormValue("content"),
+		Input:    r.FormValue("input"),
+		Image:    session.Image,
+		Language: session.Language,
+		Format:   "text/plain",
+	}
+
+	if req.Filename != "" {
+		if !validFilename(req.Filename) {
+			return nil, fmt.Errorf("Invalid filename")
+		}
+
+		if req.Content == "" {
+			return nil, fmt.Errorf("Content is required")
+		}
+
+		_, lang, err := DetectLanguage(req.Filename, req.Content, normalizeString(r.FormValue("language")))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Format = lang.Format
+		req.Language = lang.Name
+
+		// Files of the session language run with the session version
+		version := ""
+		if req.Language == session.Language {
+			version = session.Version
+		}
+
+		v, err := lang.Version(version)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Version = v.Name
+
+		if req.Command == "" {
+			req.Command = fmt.Sprintf(v.Command, req.Filename)
+		}
+	}
+
+	if req.Command == "" {
+		return nil, fmt.Errorf("Command or filename is required")
+	}
+
+	return &req, nil
+}
+
+// withSession finds the session from the url and locks it for the duration
+// of the handler
+func withSession(c *gin.Context, fn func(session *Session)) {
+	if sessionManager == nil {
+		errorResponse(404, fmt.Errorf("Sessions are not enabled"), c)
+		return
+	}
+
+	session := sessionManager.Get(c.Param("id"), sessionOwner(c))
+	if session == nil {
+		errorResponse(404, errSessionNotFound, c)
+		return
+	}
+
+	if err := session.Acquire(); err != nil {
+		errorResponse(409, err, c)
+		return
+	}
+	defer session.Release()
+
+	fn(session)
+}
+
+func HandleCreateSession(c *gin.Context) {
+	if sessionManager == nil {
+		errorResponse(404, fmt.Errorf("Sessions are not enabled"), c)
+		return
+	}
+
+	_, lang, err := FindLanguage(normalizeString(c.Request.FormValue("language")))
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	language := lang.Name
+
+	version, err := lang.Version(normalizeString(c.Request.FormValue("version")))
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	req := &Request{
+		Language:    language,
+		Version:     version.Name,
+		Image:       version.Image,
+		MemoryLimit: parseInt(c.Request.FormValue("memory_limit")),
+		Env:         strings.TrimSpace(c.Request.FormValue("env")),
+	}
+
+	limit := 0
+	if key := getApiKey(c); key != nil {
+		if err := key.Limits.Apply(req); err != nil {
+			errorResponse(403, err, c)
+			return
+		}
+
+		limit = key.Sessions
+	}
+
+	if !checkImageAvailable(c, req.Image) {
+		return
+	}
+
+	config := CurrentConfig()
+	if req.MemoryLimit == 0 || (config.MemoryLimit > 0 && req.MemoryLimit > config.MemoryLimit) {
+		req.MemoryLimit = config.MemoryLimit
+	}
+
+	session, err := sessionManager.Create(config, req, sessionOwner(c), limit)
+	if err != nil {
+		status := 400
+		if err == errTooManySessions {
+			status = 429
+		}
+
+		errorResponse(status, err, c)
+		return
+	}
+
+	c.JSON(201, session.Info())
+}
+
+func HandleSession(c *gin.Context) {
+	withSession(c, func(session *Session) {
+		c.JSON(200, session.Info())
+	})
+}
+
+func HandleSessionRun(c *gin.Context) {
+	withSession(c, func(session *Session) {
+		req, err := ParseSessionRequest(c.Request, session)
+		if err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+
+		key := getApiKey(c)
+		if key != nil {
+			if err := key.Limits.Apply(req); err != nil {
+				errorResponse(403, err, c)
+				return
+			}
+		}
+
+		config := CurrentConfig()
+		subject := usageSubject(key, "")
+
+		if !checkUsage(c, subject, usageQuotas(config, key)) {
+			return
+		}
+
+		client, exists := c.Get("client")
+		if !exists {
+			errorResponse(400, fmt.Errorf("Cant get client"), c)
+			return
+		}
+
+		run := NewRun(config, client.(*docker.Client), req, clientIP(c))
+		run.Trace = getTrace(c)
+		run.SessionId = session.Id
+		run.log = run.log.With("session_id", session.Id)
+		c.Header("X-Run-Id", run.Id)
+
+		// Shutdown waits for session runs before closing sessions
+		if err := runTracker.Begin(run); err != nil {
+			c.Header("Retry-After", strconv.Itoa(drainRetryAfter))
+			errorResponse(503, err, c)
+			return
+		}
+		defer runTracker.End(run)
+
+		c.Set("run", run)
+
+		ts := time.Now()
+		result, err := run.StartExecWithTimeout(session.Container)
+		observeRun(req, result, err, ts)
+		defer run.logAccess(c, result, err, ts)
+		defer recordRun(c, run, result, err, ts)
+		setServerTiming(c, run.Trace)
+
+		if _, timeout := err.(*TimeoutError); err == nil || timeout {
+			usageTracker.Record(subject, runUsage(run, result, time.Since(ts)))
+		}
+
+		// Timed out command is still running, the container could not be reused
+		if _, timeout := err.(*TimeoutError); timeout {
+			go sessionManager.Close(session.Id)
+			errorResponse(400, fmt.Errorf("%s, session is closed", err), c)
+			return
+		}
+
+		if err != nil {
+			errorResponse(400, err, c)
+			return
+		}
+
+		writeRunResult(c, req, result)
+	})
+}
+
+func HandleSessionFile(c *gin.Context) {
+	withSession(c, func(session *Session) {
+		serveFile(c, session.VolumePath, c.Param("path"))
+	})
+}
+
+func HandleCloseSession(c *gin.Context) {
+	if sessionManager == nil {
+		errorResponse(404, fmt.Errorf("Sessions are not enabled"), c)
+		return
+	}
+
+	if sessionManager.Get(c.Param("id"), sessionOwner(c)) == nil {
+		errorResponse(404, errSessionNotFound, c)
+		return
+	}
+
+	if err := sessionManager.Close(c.Param("id")); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, map[string]string{"status": "closed"})
+}
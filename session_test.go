@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSessionLanguages = `{
+  ".py": {
+    "name": "python",
+    "command": "python %s",
+    "versions": [
+      { "version": "2.7", "image": "python:2.7", "default": true },
+      { "version": "3.5", "image": "python:3.5", "command": "python3 %s" }
+    ]
+  },
+  ".rb": {
+    "name": "ruby",
+    "image": "bitrun/ruby:2.2",
+    "command": "ruby %s"
+  }
+}`
+
+func withTestLanguages(t *testing.T, data string) {
+	path := filepath.Join(t.TempDir(), "languages.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	langs, err := ParseLanguages(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := GetLanguages()
+	SetLanguages(langs)
+	t.Cleanup(func() { SetLanguages(prev) })
+}
+
+func TestSessionRunVersion(t *testing.T) {
+	withTestLanguages(t, testSessionLanguages)
+
+	config := &Config{SessionIdleTimeout: time.Minute, SessionMaxLifetime: time.Hour}
+	session := newSession(config, &Request{Language: "python", Version: "python@3.5", Image: "python:3.5"}, "key:abc")
+
+	if session.Version != "python@3.5" || session.Info()["version"] != "python@3.5" {
+		t.Fatalf("expected session version python@3.5, got %q", session.Version)
+	}
+
+	examples := []struct {
+		form    url.Values
+		command string
+		version string
+		image   string
+	}{
+		// Session language runs with the session version, not the default one
+		{url.Values{"filename": {"test.py"}, "content": {"print(1)"}}, "python3 test.py", "python@3.5", "python:3.5"},
+		{url.Values{"filename": {"test.rb"}, "content": {"puts 1"}}, "ruby test.rb", "ruby", "python:3.5"},
+		{url.Values{"command": {"ls -la"}}, "ls -la", "", "python:3.5"},
+	}
+
+	for _, ex := range examples {
+		r := httptest.NewRequest("POST", "/api/v1/sessions/"+session.Id+"/run", strings.NewReader(ex.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		req, err := ParseSessionRequest(r, session)
+		if err != nil {
+			t.Fatalf("%v: %v", ex.form, err)
+		}
+
+		if req.Command != ex.command || req.Version != ex.version || req.Image != ex.image {
+			t.Errorf("%v: expected %q %q %q, got %q %q %q", ex.form, ex.command, ex.version, ex.image, req.Command, req.Version, req.Image)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Number of seconds clients are asked to wait before retrying during shutdown
+const drainRetryAfter = 10
+
+var runTracker = NewRunTracker()
+
+type RunTracker struct {
+	Runs     map[string]*Run
+	draining bool
+	wg       sync.WaitGroup
+	sync.Mutex
+}
+
+func NewRunTracker() *RunTracker {
+	return &RunTracker{
+		Runs: map[string]*Run{},
+	}
+}
+
+func (t *RunTracker) Begin(run *Run) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.draining {
+		return fmt.Errorf("Server is shutting down")
+	}
+
+	t.Runs[run.Id] = run
+	t.wg.Add(1)
+	return nil
+}
+
+// Add tracks a container started for a run already in flight, such as a
+// dependency install. Unlike Begin it is allowed while draining.
+func (t *RunTracker) Add(run *Run) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.Runs[run.Id] = run
+	t.wg.Add(1)
+}
+
+func (t *RunTracker) End(run *Run) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.Runs[run.Id] != nil {
+		delete(t.Runs, run.Id)
+		t.wg.Done()
+	}
+}
+
+func (t *RunTracker) Count() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.Runs)
+}
+
+func (t *RunTracker) Draining() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.draining
+}
+
+func (t *RunTracker) Drain() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.draining = true
+}
+
+// Wait blocks until all in-flight runs are finished or timeout is reached
+func (t *RunTracker) Wait(timeout time.Duration) bool {
+	chDone := make(chan bool)
+
+	go func() {
+		t.wg.Wait()
+		close(chDone)
+	}()
+
+	select {
+	case <-chDone:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *RunTracker) DestroyAll() {
+	t.Lock()
+	runs := []*Run{}
+	for _, run := range t.Runs {
+		runs = append(runs, run)
+	}
+	t.Unlock()
+
+	for _, run := range runs {
+		run.Log().Warn("destroying unfinished run")
+		run.Destroy()
+	}
+}
+
+func drainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if runTracker.Draining() {
+			c.Header("Retry-After", strconv.Itoa(drainRetryAfter))
+			errorResponse(503, fmt.Errorf("Server is shutting down"), c)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Shutdown stops accepting new runs, waits for in-flight ones and cleans up
+// containers before closing the http server
+func Shutdown(server *http.Server) {
+	config := CurrentConfig()
+	runTracker.Drain()
+
+	logger.Info("waiting for in-flight runs", "runs", runTracker.Count(), "timeout", config.ShutdownTimeout.String())
+
+	if !runTracker.Wait(config.ShutdownTimeout) {
+		logger.Warn("shutdown timeout reached, destroying remaining runs")
+		runTracker.DestroyAll()
+	}
+
+	if sessionManager != nil {
+		logger.Info("closing sessions", "sessions", sessionManager.Count())
+		sessionManager.CloseAll()
+	}
+
+	ShutdownPools(config.KeepPools)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("error while stopping server", "error", err)
+	}
+
+	// Handlers are done, so usage of every run is recorded
+	usageTracker.Flush()
+}
+
+func watchShutdownSignal(server *http.Server, done chan bool) {
+	chSignals := make(chan os.Signal, 2)
+	signal.Notify(chSignals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-chSignals
+	logger.Info("shutting down", "signal", sig.String())
+
+	// Second signal skips draining
+	go func() {
+		<-chSignals
+		logger.Warn("forced shutdown")
+		os.Exit(1)
+	}()
+
+	Shutdown(server)
+	close(done)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Length of snippet ids, extended when a shorter id is already taken
+const snippetIdLength = 10
+
+var SnippetIdRegexp = regexp.MustCompile(`\A[a-f\d]{10,40}\z`)
+
+var (
+	errSnippetNotFound = fmt.Errorf("Snippet does not exist")
+	errSnippetTooLarge = fmt.Errorf("Snippet is too large")
+)
+
+type SnippetFile struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// SnippetResult is the output of a shared run
+type SnippetResult struct {
+	ExitCode        int    `json:"exit_code"`
+	Duration        string `json:"duration"`
+	Output          string `json:"output"`
+	OutputTruncated bool   `json:"output_truncated,omitempty"`
+	ImageDigest     string `json:"image_digest,omitempty"`
+}
+
+// Snippet is a shared run request. Ids are content-addressed, sharing the same
+// files, input, command and image again yields the same id.
+type Snippet struct {
+	Id        string         `json:"id"`
+	Key       string         `json:"key"`
+	Language  string         `json:"language"`
+	Version   string         `json:"version,omitempty"`
+	Image     string         `json:"image"`
+	Command   string         `json:"command"`
+	Input     string         `json:"input,omitempty"`
+	Files     []*SnippetFile `json:"files"`
+	Result    *SnippetResult `json:"result,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// SnippetStore keeps snippets as JSON files for snippet_ttl seconds
+type SnippetStore struct {
+	Path string
+	sync.Mutex
+}
+
+var snippetStore *SnippetStore
+
+// NewSnippet creates a snippet from a resolved request
+func NewSnippet(req *Request) *Snippet {
+	snippet := &Snippet{
+		// Cache key does not cover the filename and language
+		Key:      sha1Sum(req.CacheKey + req.Filename + "\x00" + req.Language),
+		Language: req.Language,
+		Version:  req.Version,
+		Image:    req.Image,
+		Command:  req.Command,
+		Input:    req.Input,
+		Files: []*SnippetFile{
+			{Name: req.Filename, Content: req.Content},
+		},
+	}
+
+	if req.Manifest != "" {
+		snippet.Files = append(snippet.Files, &SnippetFile{Name: req.Deps.Manifest, Content: req.Manifest})
+	}
+
+	return snippet
+}
+
+// Request builds a run request from the snippet. Language is passed on as is,
+// it could have been set explicitly, e.g. for files without extension.
+func (snippet *Snippet) Request() (*Request, error) {
+	if len(snippet.Files) == 0 {
+		return nil, fmt.Errorf("Snippet has no files")
+	}
+
+	req := &Request{
+		Filename:        snippet.Files[0].Name,
+		Content:         snippet.Files[0].Content,
+		Input:           snippet.Input,
+		Command:         snippet.Command,
+		Image:           snippet.Image,
+		Version:         snippet.Version,
+		Language:        snippet.Language,
+		ArtifactsFormat: "json",
+	}
+
+	// Second file is the dependency manifest
+	if len(snippet.Files) > 1 {
+		req.Manifest = snippet.Files[1].Content
+	}
+
+	return req, req.resolve()
+}
+
+// checkSnippet validates that the request could be shared
+func checkSnippet(config *Config, req *Request) error {
+	if snippetStore == nil {
+		return fmt.Errorf("Snippets are not enabled")
+	}
+
+	if int64(len(req.Content)+len(req.Input)+len(req.Command)+len(req.Manifest)) > config.SnippetMaxBytes {
+		return errSnippetTooLarge
+	}
+
+	return nil
+}
+
+func snippetErrorStatus(err error) int {
+	if err == errSnippetTooLarge {
+		return 413
+	}
+
+	return 400
+}
+
+func NewSnippetStore(config *Config) (*SnippetStore, error) {
+	store := &SnippetStore{
+		Path: snippetsPath(config),
+	}
+
+	return store, os.MkdirAll(store.Path, 0755)
+}
+
+func snippetsPath(config *Config) string {
+	if config.SnippetsPath != "" {
+		return config.SnippetsPath
+	}
+
+	return filepath.Join(config.SharedPath, "snippets")
+}
+
+func (store *SnippetStore) path(id string) string {
+	return filepath.Join(store.Path, id+".json")
+}
+
+func (store *SnippetStore) read(id string) (*Snippet, error) {
+	data, err := ioutil.ReadFile(store.path(id))
+	if os.IsNotExist(err) {
+		return nil, errSnippetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snippet := &Snippet{}
+	if err := json.Unmarshal(data, snippet); err != nil {
+		return nil, err
+	}
+
+	return snippet, nil
+}
+
+func (store *SnippetStore) write(snippet *Snippet) error {
+	data, err := json.Marshal(snippet)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := store.path(snippet.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, store.path(snippet.Id))
+}
+
+// Save stores the snippet under the shortest free prefix of its key. Sharing
+// an existing snippet extends its expiration and replaces the result when a
+// new one is given.
+func (store *SnippetStore) Save(snippet *Snippet, ttl time.Duration) error {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now().UTC()
+
+	for length := snippetIdLength; length <= len(snippet.Key); length += 2 {
+		id := snippet.Key[:length]
+
+		existing, err := store.read(id)
+		if err != nil && err != errSnippetNotFound {
+			return err
+		}
+
+		if existing != nil && existing.Key != snippet.Key && now.Before(existing.ExpiresAt) {
+			continue
+		}
+
+		snippet.Id = id
+		snippet.CreatedAt = now
+		snippet.ExpiresAt = now.Add(ttl)
+
+		if existing != nil && existing.Key == snippet.Key {
+			snippet.CreatedAt = existing.CreatedAt
+			if snippet.Result == nil {
+				snippet.Result = existing.Result
+			}
+		}
+
+		return store.write(snippet)
+	}
+
+	return fmt.Errorf("Cant allocate snippet id")
+}
+
+func (store *SnippetStore) Get(id string) (*Snippet, error) {
+	if !SnippetIdRegexp.MatchString(id) {
+		return nil, errSnippetNotFound
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	snippet, err := store.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(snippet.ExpiresAt) {
+		return nil, errSnippetNotFound
+	}
+
+	return snippet, nil
+}
+
+// Cleanup removes expired snippets
+func (store *SnippetStore) Cleanup() {
+	entries, err := ioutil.ReadDir(store.Path)
+	if err != nil {
+		logger.Error("cant list snippets", "error", err)
+		return
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if !SnippetIdRegexp.MatchString(id) {
+			continue
+		}
+
+		snippet, err := store.read(id)
+		if err == errSnippetNotFound {
+			continue
+		}
+
+		// Broken files are removed as well
+		if err == nil && time.Now().Before(snippet.ExpiresAt) {
+			continue
+		}
+
+		if err := os.Remove(store.path(id)); err != nil {
+			logger.Error("cant remove snippet", "id", id, "error", err)
+		}
+	}
+}
+
+func (store *SnippetStore) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute * 10)
+			store.Cleanup()
+		}
+	}()
+}
+
+// shareRun stores the request and its result as a snippet
+func shareRun(c *gin.Context, req *Request, result *RunResult) {
+	config := CurrentConfig()
+
+	output := result.Output
+	truncated := false
+	if limit := config.SnippetOutputBytes; len(output) > limit {
+		output = output[:limit]
+		truncated = true
+	}
+
+	snippet := NewSnippet(req)
+	snippet.Result = &SnippetResult{
+		ExitCode:        result.ExitCode,
+		Duration:        result.Duration,
+		Output:          string(output),
+		OutputTruncated: truncated,
+		ImageDigest:     result.ImageDigest,
+	}
+
+	if err := snippetStore.Save(snippet, config.SnippetTTL); err != nil {
+		logger.Error("cant save snippet", "error", err)
+		return
+	}
+
+	c.Header("X-Snippet-Id", snippet.Id)
+}
+
+func HandleCreateSnippet(c *gin.Context) {
+	req, err := ParseRequest(c.Request)
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	// Snippets are only shared within the limits of the key creating them
+	if key := getApiKey(c); key != nil {
+		if err := key.Limits.Apply(req); err != nil {
+			errorResponse(403, err, c)
+			return
+		}
+	}
+
+	config := CurrentConfig()
+
+	if err := checkSnippet(config, req); err != nil {
+		errorResponse(snippetErrorStatus(err), err, c)
+		return
+	}
+
+	snippet := NewSnippet(req)
+	if err := snippetStore.Save(snippet, config.SnippetTTL); err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, snippet)
+}
+
+func HandleSnippet(c *gin.Context) {
+	if snippetStore == nil {
+		errorResponse(404, fmt.Errorf("Snippets are not enabled"), c)
+		return
+	}
+
+	snippet, err := snippetStore.Get(c.Param("id"))
+	if err != nil {
+		errorResponse(404, errSnippetNotFound, c)
+		return
+	}
+
+	c.JSON(200, snippet)
+}
+
+func HandleSnippetRun(c *gin.Context) {
+	if snippetStore == nil {
+		errorResponse(404, fmt.Errorf("Snippets are not enabled"), c)
+		return
+	}
+
+	snippet, err := snippetStore.Get(c.Param("id"))
+	if err != nil {
+		errorResponse(404, errSnippetNotFound, c)
+		return
+	}
+
+	req, err := snippet.Request()
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	handleRunRequest(c, req)
+}
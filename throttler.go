@@ -1,85 +1,329 @@
 package main
 
 import (
-	"fmt"
+	"math"
 	"sync"
 	"time"
 )
 
-type Throttler struct {
-	Concurrency int
+// ThrottleLimits define a token bucket refilled with Quota tokens per Window
+// and holding up to Burst tokens, and the number of concurrent requests
+type ThrottleLimits struct {
 	Quota       int
-	Clients     map[string]int
-	Requests    map[string]int
-	Whitelist   map[string]bool
+	Burst       int
+	Window      time.Duration
+	Concurrency int
+}
+
+// ThrottleRule overrides default limits for an IP, CIDR range or a namespace
+type ThrottleRule struct {
+	Ip          string `json:"ip"`
+	Namespace   string `json:"namespace"`
+	Quota       int    `json:"quota"`
+	Burst       int    `json:"burst"`
+	Window      int    `json:"window"`
+	Concurrency int    `json:"concurrency"`
+}
+
+type ThrottleStatus struct {
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// ThrottleError is returned when a request exceeds its limits, any other
+// error returned by a backend means the backend itself failed
+type ThrottleError struct {
+	Message string
+}
+
+func (err *ThrottleError) Error() string {
+	return err.Message
+}
+
+var (
+	errTooManyRequests   = &ThrottleError{"Too many requests"}
+	errTooManyConcurrent = &ThrottleError{"Too many concurrent requests"}
+)
+
+// ThrottleBackend stores buckets and concurrency counters
+type ThrottleBackend interface {
+	// Take consumes a token and registers a concurrent request
+	Take(id string, limits ThrottleLimits) (*ThrottleStatus, error)
+	// Release unregisters a concurrent request
+	Release(id string) error
+}
+
+type Throttler struct {
+	Defaults  ThrottleLimits
+	Rules     []ThrottleRule
+	Whitelist *IPMatcher
+	Backend   ThrottleBackend
+	rulesIps  []*IPMatcher
 	*sync.Mutex
 }
 
-func NewThrottler(concurrency int, quota int) *Throttler {
+func NewThrottler(defaults ThrottleLimits, backend ThrottleBackend) *Throttler {
 	return &Throttler{
-		Concurrency: concurrency,
-		Quota:       quota,
-		Clients:     make(map[string]int),
-		Requests:    make(map[string]int),
-		Whitelist:   make(map[string]bool),
-		Mutex:       &sync.Mutex{},
+		Defaults:  defaults,
+		Rules:     []ThrottleRule{},
+		Whitelist: &IPMatcher{},
+		Backend:   backend,
+		Mutex:     &sync.Mutex{},
 	}
 }
 
-func (t *Throttler) StartPeriodicFlush() {
-	go func() {
-		for {
-			t.Flush()
-			time.Sleep(time.Second * 5)
-		}
-	}()
+// NewThrottleBackend creates the backend selected in config
+func NewThrottleBackend(config *Config) ThrottleBackend {
+	if config.ThrottleBackend == "redis" {
+		client := NewRedisClient(config.RedisAddress, config.RedisPassword, config.RedisDB)
+		return NewRedisThrottleBackend(client, config.RedisPrefix)
+	}
+
+	backend := NewMemoryThrottleBackend()
+	backend.StartPeriodicCleanup()
+
+	return backend
 }
 
-func (t *Throttler) Add(ip string) error {
-	t.Lock()
-	defer t.Unlock()
+func NewThrottleLimits(config *Config) ThrottleLimits {
+	return ThrottleLimits{
+		Quota:       config.ThrottleQuota,
+		Burst:       config.ThrottleBurst,
+		Window:      config.ThrottleWindow,
+		Concurrency: config.ThrottleConcurrency,
+	}
+}
 
-	t.Requests[ip]++
+// Override returns limits with non-zero values replaced. Window is in seconds.
+func (limits ThrottleLimits) Override(quota int, burst int, window int, concurrency int) ThrottleLimits {
+	if quota > 0 {
+		limits.Quota = quota
+		limits.Burst = 0
+	}
 
-	if t.Requests[ip] > t.Quota || t.Clients[ip] >= t.Concurrency {
-		return fmt.Errorf("Too many requests")
+	if burst > 0 {
+		limits.Burst = burst
 	}
 
-	t.Clients[ip]++
-	return nil
+	if window > 0 {
+		limits.Window = time.Duration(window) * time.Second
+	}
+
+	if concurrency > 0 {
+		limits.Concurrency = concurrency
+	}
+
+	return limits
+}
+
+func (limits ThrottleLimits) capacity() float64 {
+	if limits.Burst > 0 {
+		return float64(limits.Burst)
+	}
+
+	return float64(limits.Quota)
+}
+
+// rate returns the number of tokens added per second
+func (limits ThrottleLimits) rate() float64 {
+	if limits.Window <= 0 {
+		return float64(limits.Quota)
+	}
+
+	return float64(limits.Quota) / limits.Window.Seconds()
+}
+
+// refill returns the number of tokens in a bucket after elapsed time
+func (limits ThrottleLimits) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(limits.capacity(), tokens+elapsed.Seconds()*limits.rate())
+}
+
+// status describes a bucket holding the given number of tokens
+func (limits ThrottleLimits) status(tokens float64) *ThrottleStatus {
+	status := &ThrottleStatus{
+		Limit:     int(limits.capacity()),
+		Remaining: int(math.Floor(tokens)),
+	}
+
+	if rate := limits.rate(); rate > 0 {
+		status.Reset = time.Duration((limits.capacity() - tokens) / rate * float64(time.Second))
+
+		if tokens < 1 {
+			status.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+		}
+	}
+
+	return status
 }
 
-func (t *Throttler) Remove(ip string) {
+func (t *Throttler) Configure(config *Config) {
 	t.Lock()
 	defer t.Unlock()
 
-	t.Clients[ip]--
+	t.Defaults = NewThrottleLimits(config)
+	t.Rules = config.ThrottleRules
+	t.rulesIps = make([]*IPMatcher, len(t.Rules))
 
-	if t.Clients[ip] < 0 {
-		t.Clients[ip] = 0
+	for i, rule := range t.Rules {
+		if rule.Ip != "" {
+			t.rulesIps[i], _ = NewIPMatcher([]string{rule.Ip})
+		}
 	}
 }
 
-func (t *Throttler) Flush() {
+// Subject returns throttling id and limits for a request. Api keys take
+// precedence over namespace rules, which take precedence over IP rules.
+func (t *Throttler) Subject(ip string, namespace string, key *ApiKey) (string, ThrottleLimits) {
 	t.Lock()
 	defer t.Unlock()
 
-	for k := range t.Clients {
-		delete(t.Clients, k)
+	if key != nil {
+		limits := t.Defaults.Override(key.Quota, key.Burst, key.Window, key.Concurrency)
+		return "key:" + key.Id, limits
 	}
 
-	for k := range t.Requests {
-		delete(t.Requests, k)
+	if namespace != "" {
+		for _, rule := range t.Rules {
+			if rule.Namespace == namespace {
+				return "ns:" + namespace, t.Defaults.Override(rule.Quota, rule.Burst, rule.Window, rule.Concurrency)
+			}
+		}
+	}
+
+	for i, rule := range t.Rules {
+		if t.rulesIps[i].Contains(ip) {
+			return "ip:" + ip, t.Defaults.Override(rule.Quota, rule.Burst, rule.Window, rule.Concurrency)
+		}
+	}
+
+	return "ip:" + ip, t.Defaults
+}
+
+func (t *Throttler) Add(id string, limits ThrottleLimits) (*ThrottleStatus, error) {
+	return t.Backend.Take(id, limits)
+}
+
+func (t *Throttler) Remove(id string) {
+	if err := t.Backend.Release(id); err != nil {
+		logger.Error("throttle release failed", "id", id, "error", err)
 	}
 }
 
+// SetWhitelist accepts IPs and CIDR ranges, invalid entries are skipped
 func (t *Throttler) SetWhitelist(ips []string) {
+	whitelist := &IPMatcher{}
+
 	for _, ip := range ips {
-		t.Whitelist[ip] = true
+		matcher, err := NewIPMatcher([]string{ip})
+		if err != nil {
+			logger.Warn("invalid throttle whitelist entry", "ip", ip)
+			continue
+		}
+
+		whitelist.nets = append(whitelist.nets, matcher.nets...)
 	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.Whitelist = whitelist
 }
 
 func (t *Throttler) Whitelisted(ip string) bool {
-	_, ok := t.Whitelist[ip]
-	return ok
+	t.Lock()
+	defer t.Unlock()
+
+	return t.Whitelist.Contains(ip)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limits  ThrottleLimits
+}
+
+// MemoryThrottleBackend keeps buckets in process memory
+type MemoryThrottleBackend struct {
+	buckets map[string]*bucket
+	clients map[string]int
+	// Clock used for refills, replaced in tests
+	now func() time.Time
+	sync.Mutex
+}
+
+func NewMemoryThrottleBackend() *MemoryThrottleBackend {
+	return &MemoryThrottleBackend{
+		buckets: make(map[string]*bucket),
+		clients: make(map[string]int),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryThrottleBackend) Take(id string, limits ThrottleLimits) (*ThrottleStatus, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	b := m.buckets[id]
+
+	if b == nil || b.limits != limits {
+		b = &bucket{tokens: limits.capacity(), updated: now, limits: limits}
+		m.buckets[id] = b
+	} else {
+		b.tokens = limits.refill(b.tokens, now.Sub(b.updated))
+		b.updated = now
+	}
+
+	if limits.Concurrency > 0 && m.clients[id] >= limits.Concurrency {
+		status := limits.status(b.tokens)
+		status.RetryAfter = time.Second
+		return status, errTooManyConcurrent
+	}
+
+	if b.tokens < 1 {
+		return limits.status(b.tokens), errTooManyRequests
+	}
+
+	b.tokens--
+	m.clients[id]++
+
+	return limits.status(b.tokens), nil
+}
+
+func (m *MemoryThrottleBackend) Release(id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.clients[id]--
+
+	if m.clients[id] <= 0 {
+		delete(m.clients, id)
+	}
+
+	return nil
+}
+
+// Cleanup removes buckets that are full and have no requests in flight
+func (m *MemoryThrottleBackend) Cleanup() {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+
+	for id, b := range m.buckets {
+		if m.clients[id] == 0 && b.limits.refill(b.tokens, now.Sub(b.updated)) >= b.limits.capacity() {
+			delete(m.buckets, id)
+		}
+	}
+}
+
+func (m *MemoryThrottleBackend) StartPeriodicCleanup() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			m.Cleanup()
+		}
+	}()
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for the memory backend
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+func newTestBackend() (*MemoryThrottleBackend, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	backend := NewMemoryThrottleBackend()
+	backend.now = clock.Now
+
+	return backend, clock
+}
+
+func TestThrottleLimitsStatus(t *testing.T) {
+	examples := []struct {
+		name   string
+		limits ThrottleLimits
+		tokens float64
+		status ThrottleStatus
+	}{
+		{
+			name:   "full bucket",
+			limits: ThrottleLimits{Quota: 10, Window: 10 * time.Second},
+			tokens: 10,
+			status: ThrottleStatus{Limit: 10, Remaining: 10},
+		},
+		{
+			name:   "partial bucket",
+			limits: ThrottleLimits{Quota: 10, Window: 10 * time.Second},
+			tokens: 4.5,
+			status: ThrottleStatus{Limit: 10, Remaining: 4, Reset: 5500 * time.Millisecond},
+		},
+		{
+			name:   "less than a token",
+			limits: ThrottleLimits{Quota: 10, Window: 10 * time.Second},
+			tokens: 0.25,
+			status: ThrottleStatus{Limit: 10, Remaining: 0, Reset: 9750 * time.Millisecond, RetryAfter: 750 * time.Millisecond},
+		},
+		{
+			name:   "burst caps the bucket",
+			limits: ThrottleLimits{Quota: 60, Burst: 5, Window: time.Minute},
+			tokens: 0,
+			status: ThrottleStatus{Limit: 5, Remaining: 0, Reset: 5 * time.Second, RetryAfter: time.Second},
+		},
+		{
+			name:   "quota per second without window",
+			limits: ThrottleLimits{Quota: 4},
+			tokens: 0,
+			status: ThrottleStatus{Limit: 4, Remaining: 0, Reset: time.Second, RetryAfter: 250 * time.Millisecond},
+		},
+		{
+			name:   "no quota",
+			limits: ThrottleLimits{},
+			tokens: 0,
+			status: ThrottleStatus{},
+		},
+	}
+
+	for _, ex := range examples {
+		status := ex.limits.status(ex.tokens)
+
+		if *status != ex.status {
+			t.Errorf("%s: expected %+v, got %+v", ex.name, ex.status, *status)
+		}
+	}
+}
+
+func TestMemoryThrottleBackendRefill(t *testing.T) {
+	type step struct {
+		advance    time.Duration
+		err        error
+		remaining  int
+		retryAfter time.Duration
+	}
+
+	examples := []struct {
+		name   string
+		limits ThrottleLimits
+		steps  []step
+	}{
+		{
+			name:   "refill over window",
+			limits: ThrottleLimits{Quota: 2, Window: 8 * time.Second},
+			steps: []step{
+				{0, nil, 1, 0},
+				// The next request has to wait for a token
+				{0, nil, 0, 4 * time.Second},
+				{0, errTooManyRequests, 0, 4 * time.Second},
+				{2 * time.Second, errTooManyRequests, 0, 2 * time.Second},
+				{2 * time.Second, nil, 0, 4 * time.Second},
+				// Refill never exceeds the bucket capacity
+				{time.Hour, nil, 1, 0},
+			},
+		},
+		{
+			name:   "burst smaller than quota",
+			limits: ThrottleLimits{Quota: 10, Burst: 3, Window: 10 * time.Second},
+			steps: []step{
+				{0, nil, 2, 0},
+				{0, nil, 1, 0},
+				{0, nil, 0, time.Second},
+				{0, errTooManyRequests, 0, time.Second},
+				{500 * time.Millisecond, errTooManyRequests, 0, 500 * time.Millisecond},
+				{500 * time.Millisecond, nil, 0, time.Second},
+				{time.Minute, nil, 2, 0},
+			},
+		},
+	}
+
+	for _, ex := range examples {
+		backend, clock := newTestBackend()
+
+		for i, s := range ex.steps {
+			clock.Advance(s.advance)
+
+			status, err := backend.Take("ip:1.2.3.4", ex.limits)
+			if err == nil {
+				backend.Release("ip:1.2.3.4")
+			}
+
+			if err != s.err {
+				t.Fatalf("%s, step %d: expected error %v, got %v", ex.name, i+1, s.err, err)
+			}
+
+			if status.Remaining != s.remaining || status.RetryAfter != s.retryAfter {
+				t.Errorf("%s, step %d: expected remaining %d and retry after %v, got %d and %v",
+					ex.name, i+1, s.remaining, s.retryAfter, status.Remaining, status.RetryAfter)
+			}
+		}
+	}
+}
+
+func TestMemoryThrottleBackendConcurrency(t *testing.T) {
+	backend, _ := newTestBackend()
+	limits := ThrottleLimits{Quota: 10, Window: time.Minute, Concurrency: 2}
+
+	for i := 0; i < 2; i++ {
+		if _, err := backend.Take("key:abc", limits); err != nil {
+			t.Fatalf("expected request %d to pass, got %v", i+1, err)
+		}
+	}
+
+	status, err := backend.Take("key:abc", limits)
+	if err != errTooManyConcurrent {
+		t.Fatalf("expected %v, got %v", errTooManyConcurrent, err)
+	}
+
+	// Rejected concurrent requests do not consume tokens
+	if status.Remaining != 8 {
+		t.Errorf("expected 8 remaining, got %d", status.Remaining)
+	}
+
+	backend.Release("key:abc")
+
+	if _, err := backend.Take("key:abc", limits); err != nil {
+		t.Errorf("expected request to pass after release, got %v", err)
+	}
+}
+
+func TestMemoryThrottleBackendLimitsChange(t *testing.T) {
+	backend, _ := newTestBackend()
+
+	backend.Take("ip:1.2.3.4", ThrottleLimits{Quota: 1, Window: time.Minute})
+	backend.Release("ip:1.2.3.4")
+
+	// Bucket starts over when limits of the subject change, e.g. on reload
+	status, err := backend.Take("ip:1.2.3.4", ThrottleLimits{Quota: 5, Window: time.Minute})
+	if err != nil {
+		t.Fatalf("expected request to pass, got %v", err)
+	}
+
+	if status.Remaining != 4 {
+		t.Errorf("expected 4 remaining, got %d", status.Remaining)
+	}
+}
+
+func TestMemoryThrottleBackendCleanup(t *testing.T) {
+	backend, clock := newTestBackend()
+	limits := ThrottleLimits{Quota: 2, Window: 8 * time.Second}
+
+	backend.Take("ip:1.2.3.4", limits)
+	backend.Release("ip:1.2.3.4")
+	backend.Take("ip:5.6.7.8", limits)
+
+	clock.Advance(2 * time.Second)
+	backend.Cleanup()
+
+	if _, ok := backend.buckets["ip:1.2.3.4"]; !ok {
+		t.Errorf("expected bucket that is not refilled to be kept")
+	}
+
+	clock.Advance(2 * time.Second)
+	backend.Cleanup()
+
+	if _, ok := backend.buckets["ip:1.2.3.4"]; ok {
+		t.Errorf("expected refilled bucket to be removed")
+	}
+
+	if _, ok := backend.buckets["ip:5.6.7.8"]; !ok {
+		t.Errorf("expected bucket with a request in flight to be kept")
+	}
+}
+
+func TestThrottlerSubject(t *testing.T) {
+	throttler := NewThrottler(ThrottleLimits{}, NewMemoryThrottleBackend())
+	throttler.Configure(&Config{
+		ThrottleQuota:  10,
+		ThrottleBurst:  20,
+		ThrottleWindow: time.Minute,
+		ThrottleRules: []ThrottleRule{
+			{Ip: "10.0.0.0/8", Quota: 100},
+			{Namespace: "docs", Quota: 50, Concurrency: 5},
+			{Ip: "192.168.1.1", Window: 10},
+		},
+	})
+
+	defaults := ThrottleLimits{Quota: 10, Burst: 20, Window: time.Minute}
+	key := &ApiKey{Id: "abc", Limits: Limits{Quota: 5}}
+
+	examples := []struct {
+		name      string
+		ip        string
+		namespace string
+		key       *ApiKey
+		id        string
+		limits    ThrottleLimits
+	}{
+		{"no rule", "1.2.3.4", "", nil, "ip:1.2.3.4", defaults},
+		{"ip range rule", "10.1.2.3", "", nil, "ip:10.1.2.3", ThrottleLimits{Quota: 100, Window: time.Minute}},
+		{"single ip rule", "192.168.1.1", "", nil, "ip:192.168.1.1", ThrottleLimits{Quota: 10, Burst: 20, Window: 10 * time.Second}},
+		{"namespace over ip", "10.1.2.3", "docs", nil, "ns:docs", ThrottleLimits{Quota: 50, Window: time.Minute, Concurrency: 5}},
+		{"unknown namespace", "10.1.2.3", "other", nil, "ip:10.1.2.3", ThrottleLimits{Quota: 100, Window: time.Minute}},
+		{"key over namespace", "10.1.2.3", "docs", key, "key:abc", ThrottleLimits{Quota: 5, Window: time.Minute}},
+		{"key without limits", "1.2.3.4", "", &ApiKey{Id: "def"}, "key:def", defaults},
+	}
+
+	for _, ex := range examples {
+		id, limits := throttler.Subject(ex.ip, ex.namespace, ex.key)
+
+		if id != ex.id || limits != ex.limits {
+			t.Errorf("%s: expected %s %+v, got %s %+v", ex.name, ex.id, ex.limits, id, limits)
+		}
+	}
+}
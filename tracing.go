@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+const traceServiceName = "bitrun-api"
+
+var traceparentRegexp = regexp.MustCompile(`\A00-([a-f\d]{32})-([a-f\d]{16})-([a-f\d]{2})\z`)
+
+type Span struct {
+	TraceId    string
+	SpanId     string
+	ParentId   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+	Server     bool
+	trace      *Trace
+}
+
+// Trace holds all spans produced while handling a single request
+type Trace struct {
+	TraceId  string
+	ParentId string
+	Sampled  bool
+	Root     *Span
+	Spans    []*Span
+	sync.Mutex
+}
+
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+type Tracer struct {
+	Exporter SpanExporter
+	queue    chan []*Span
+}
+
+var tracer *Tracer
+
+// NewTrace starts a trace continuing the W3C traceparent header, if valid
+func NewTrace(name string, traceparent string) *Trace {
+	trace := &Trace{Sampled: true}
+
+	if m := traceparentRegexp.FindStringSubmatch(strings.ToLower(traceparent)); m != nil && m[1] != strings.Repeat("0", 32) {
+		flags, _ := strconv.ParseUint(m[3], 16, 8)
+
+		trace.TraceId = m[1]
+		trace.ParentId = m[2]
+		trace.Sampled = flags&1 == 1
+	} else {
+		trace.TraceId, _ = randomHex(16)
+	}
+
+	trace.Root = trace.StartSpan(name)
+	trace.Root.Server = true
+	trace.Root.ParentId = trace.ParentId
+
+	return trace
+}
+
+// StartSpan creates a child span of the trace root. Safe to call on nil trace.
+func (trace *Trace) StartSpan(name string) *Span {
+	if trace == nil {
+		return nil
+	}
+
+	id, _ := randomHex(8)
+	span := &Span{
+		TraceId:    trace.TraceId,
+		SpanId:     id,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		trace:      trace,
+	}
+
+	trace.Lock()
+	defer trace.Unlock()
+
+	if trace.Root != nil {
+		span.ParentId = trace.Root.SpanId
+	}
+
+	trace.Spans = append(trace.Spans, span)
+	return span
+}
+
+// ServerTiming formats finished child spans for the Server-Timing header
+func (trace *Trace) ServerTiming() string {
+	if trace == nil {
+		return ""
+	}
+
+	trace.Lock()
+	defer trace.Unlock()
+
+	metrics := []string{}
+
+	for _, span := range trace.Spans {
+		if span == trace.Root || span.End.IsZero() {
+			continue
+		}
+
+		ms := float64(span.End.Sub(span.Start).Nanoseconds()) / 1e6
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", span.Name, ms))
+	}
+
+	return strings.Join(metrics, ", ")
+}
+
+func (trace *Trace) Finish() {
+	trace.Root.Finish(nil)
+
+	if tracer == nil || !trace.Sampled {
+		return
+	}
+
+	// Spans of a run that outlives the request are still being changed, so
+	// exporters get copies taken under the lock. Spans that are still open,
+	// e.g. a timed out exec, end with the trace and are marked as errors.
+	trace.Lock()
+	spans := make([]*Span, len(trace.Spans))
+	for i, span := range trace.Spans {
+		spans[i] = span.snapshot()
+
+		if spans[i].End.IsZero() {
+			spans[i].End = trace.Root.End
+			spans[i].Error = "Span was not finished"
+		}
+	}
+	trace.Unlock()
+
+	tracer.Enqueue(spans)
+}
+
+// snapshot returns a copy of the span detached from its trace, the trace lock
+// must be held
+func (span *Span) snapshot() *Span {
+	result := *span
+	result.trace = nil
+	result.Attributes = make(map[string]string, len(span.Attributes))
+
+	for k, v := range span.Attributes {
+		result.Attributes[k] = v
+	}
+
+	return &result
+}
+
+func (span *Span) SetAttribute(key string, val string) {
+	if span == nil {
+		return
+	}
+
+	span.trace.Lock()
+	defer span.trace.Unlock()
+
+	span.Attributes[key] = val
+}
+
+// Finish records span end time and optional error. Safe to call on nil span.
+func (span *Span) Finish(err error) {
+	if span == nil {
+		return
+	}
+
+	span.trace.Lock()
+	defer span.trace.Unlock()
+
+	if !span.End.IsZero() {
+		return
+	}
+
+	span.End = time.Now()
+	if err != nil {
+		span.Error = err.Error()
+	}
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	t := &Tracer{
+		Exporter: exporter,
+		queue:    make(chan []*Span, 100),
+	}
+
+	go t.run()
+	return t
+}
+
+func (t *Tracer) Enqueue(spans []*Span) {
+	select {
+	case t.queue <- spans:
+	default:
+		logger.Warn("trace export queue is full, dropping spans", "spans", len(spans))
+	}
+}
+
+func (t *Tracer) run() {
+	for spans := range t.queue {
+		if err := t.Exporter.Export(spans); err != nil {
+			logger.Error("trace export failed", "error", err)
+		}
+	}
+}
+
+// OTLP JSON encoding, see opentelemetry-proto trace/v1
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope map[string]string `json:"scope"`
+	Spans []otlpSpan        `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   map[string][]otlpAttribute `json:"resource"`
+	ScopeSpans []otlpScopeSpans           `json:"scopeSpans"`
+}
+
+type otlpPayload struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOtlpSpan(span *Span) otlpSpan {
+	result := otlpSpan{
+		TraceId:           span.TraceId,
+		SpanId:            span.SpanId,
+		ParentSpanId:      span.ParentId,
+		Name:              span.Name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+
+	if span.Server {
+		result.Kind = 2
+	}
+
+	for k, v := range span.Attributes {
+		result.Attributes = append(result.Attributes, otlpAttribute{k, otlpValue{v}})
+	}
+
+	if span.Error != "" {
+		result.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	return result
+}
+
+func newOtlpPayload(spans []*Span) otlpPayload {
+	items := []otlpSpan{}
+	for _, span := range spans {
+		items = append(items, newOtlpSpan(span))
+	}
+
+	return otlpPayload{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: map[string][]otlpAttribute{
+					"attributes": {{"service.name", otlpValue{traceServiceName}}},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: map[string]string{"name": "bitrun", "version": VERSION},
+						Spans: items,
+					},
+				},
+			},
+		},
+	}
+}
+
+// OtlpExporter sends spans to an OTLP/HTTP collector using JSON encoding
+type OtlpExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func NewOtlpExporter(endpoint string) *OtlpExporter {
+	return &OtlpExporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+func (e *OtlpExporter) Export(spans []*Span) error {
+	data, err := json.Marshal(newOtlpPayload(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// FileExporter appends spans to a local file, one OTLP JSON span per line
+type FileExporter struct {
+	Path string
+	sync.Mutex
+}
+
+func NewFileExporter(path string) *FileExporter {
+	return &FileExporter{Path: expandPath(path)}
+}
+
+func (e *FileExporter) Export(spans []*Span) error {
+	e.Lock()
+	defer e.Unlock()
+
+	file, err := os.OpenFile(e.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, span := range spans {
+		if err := encoder.Encode(newOtlpSpan(span)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTraceConfig(config *Config) error {
+	switch config.TraceExporter {
+	case "":
+	case "otlp":
+		if config.TraceEndpoint == "" {
+			return fmt.Errorf("Trace endpoint is required for otlp exporter")
+		}
+	case "file":
+		if config.TraceFile == "" {
+			return fmt.Errorf("Trace file is required for file exporter")
+		}
+	default:
+		return fmt.Errorf("Trace exporter must be otlp or file")
+	}
+
+	return nil
+}
+
+// setupTracer must be called once on startup
+func setupTracer(config *Config) {
+	switch config.TraceExporter {
+	case "otlp":
+		tracer = NewTracer(NewOtlpExporter(config.TraceEndpoint))
+	case "file":
+		tracer = NewTracer(NewFileExporter(config.TraceFile))
+	}
+}
+
+func traceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		trace := NewTrace(c.Request.Method+" "+c.FullPath(), c.Request.Header.Get("traceparent"))
+		trace.Root.SetAttribute("http.method", c.Request.Method)
+		trace.Root.SetAttribute("http.target", c.Request.URL.Path)
+		trace.Root.SetAttribute("client_ip", clientIP(c))
+
+		c.Set("trace", trace)
+		c.Next()
+
+		trace.Root.SetAttribute("http.status_code", strconv.Itoa(c.Writer.Status()))
+		trace.Finish()
+	}
+}
+
+func getTrace(c *gin.Context) *Trace {
+	if trace, exists := c.Get("trace"); exists {
+		return trace.(*Trace)
+	}
+
+	return nil
+}
+
+func setServerTiming(c *gin.Context, trace *Trace) {
+	if timing := trace.ServerTiming(); timing != "" {
+		c.Header("Server-Timing", timing)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureExporter hands exported spans over to the test
+type captureExporter struct {
+	spans chan []*Span
+}
+
+func (e *captureExporter) Export(spans []*Span) error {
+	e.spans <- spans
+	return nil
+}
+
+func withTestTracer(t *testing.T, exporter SpanExporter) {
+	prev := tracer
+	tracer = NewTracer(exporter)
+	t.Cleanup(func() { tracer = prev })
+}
+
+func TestTraceExportSnapshot(t *testing.T) {
+	exporter := &captureExporter{spans: make(chan []*Span, 1)}
+	withTestTracer(t, exporter)
+
+	trace := NewTrace("POST /api/v1/run", "")
+	run := trace.StartSpan("run")
+	run.SetAttribute("image", "bitrun/ruby:2.2")
+	exec := trace.StartSpan("start_exec")
+
+	// Run goroutine keeps changing its span while the trace is exported
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			run.SetAttribute(fmt.Sprintf("attr.%d", i), "val")
+		}
+		run.Finish(fmt.Errorf("Timeout"))
+	}()
+
+	trace.Finish()
+
+	var spans []*Span
+	select {
+	case spans = <-exporter.spans:
+	case <-time.After(time.Second):
+		t.Fatal("spans were not exported")
+	}
+
+	// Exporters encode spans while the run is still going
+	newOtlpPayload(spans)
+	wg.Wait()
+
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	if spans[0].SpanId != trace.Root.SpanId || spans[0].End.IsZero() || !spans[0].Server {
+		t.Errorf("expected finished root span, got %+v", spans[0])
+	}
+
+	if spans[1].Attributes["image"] != "bitrun/ruby:2.2" || spans[1].ParentId != trace.Root.SpanId {
+		t.Errorf("expected run span with attributes, got %+v", spans[1])
+	}
+
+	if spans[1] == run {
+		t.Errorf("expected exported span to be a copy")
+	}
+
+	// Open span ends with the trace, the original is left open
+	if !spans[2].End.Equal(spans[0].End) || spans[2].Error != "Span was not finished" || !exec.End.IsZero() {
+		t.Errorf("expected open span to end with the trace, got %+v", spans[2])
+	}
+
+	otlp := newOtlpSpan(spans[2])
+	if end, _ := strconv.ParseInt(otlp.EndTimeUnixNano, 10, 64); end < spans[2].Start.UnixNano() || otlp.Status.Code != 2 {
+		t.Errorf("unexpected open span encoding: %+v", otlp)
+	}
+}
+
+func TestTraceNotSampled(t *testing.T) {
+	exporter := &captureExporter{spans: make(chan []*Span, 1)}
+	withTestTracer(t, exporter)
+
+	trace := NewTrace("GET /api/v1/config", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	trace.Finish()
+
+	select {
+	case <-exporter.spans:
+		t.Errorf("expected unsampled trace not to be exported")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if trace.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || trace.Root.ParentId != "00f067aa0ba902b7" {
+		t.Errorf("expected trace to continue traceparent, got %s %s", trace.TraceId, trace.Root.ParentId)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter := NewFileExporter(path)
+
+	trace := NewTrace("POST /api/v1/run", "")
+	span := trace.StartSpan("docker.create")
+	span.SetAttribute("image", "bitrun/ruby:2.2")
+	span.Finish(fmt.Errorf("No such image"))
+	trace.Root.Finish(nil)
+
+	if err := exporter.Export([]*Span{trace.Root.snapshot(), span.snapshot()}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := []otlpSpan{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		item := otlpSpan{}
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			t.Fatalf("invalid span line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, item)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(lines))
+	}
+
+	if lines[0].Kind != 2 || lines[0].TraceId != trace.TraceId || lines[0].Status.Code != 1 {
+		t.Errorf("unexpected root span: %+v", lines[0])
+	}
+
+	if lines[1].Kind != 1 || lines[1].ParentSpanId != trace.Root.SpanId || lines[1].Status.Code != 2 || lines[1].Status.Message != "No such image" {
+		t.Errorf("unexpected child span: %+v", lines[1])
+	}
+
+	if len(lines[1].Attributes) != 1 || lines[1].Attributes[0].Key != "image" {
+		t.Errorf("expected image attribute, got %+v", lines[1].Attributes)
+	}
+}
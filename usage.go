@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Usage is resource consumption accumulated over a period. Memory is
+// measured in megabyte-seconds of the container memory limit.
+type Usage struct {
+	Runs             int64   `json:"runs"`
+	ContainerSeconds float64 `json:"container_seconds"`
+	MemorySeconds    float64 `json:"memory_seconds"`
+	OutputBytes      int64   `json:"output_bytes"`
+}
+
+// UsageQuota limits usage over a period, zero values mean no limit
+type UsageQuota struct {
+	ContainerSeconds float64 `json:"container_seconds,omitempty"`
+	MemorySeconds    float64 `json:"memory_seconds,omitempty"`
+	OutputBytes      int64   `json:"output_bytes,omitempty"`
+}
+
+// UsagePeriod is a calendar day or month in UTC
+type UsagePeriod struct {
+	Name  string    `json:"-"`
+	Id    string    `json:"period"`
+	Reset time.Time `json:"reset"`
+}
+
+type QuotaError struct {
+	Period   UsagePeriod
+	Resource string
+}
+
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("The %s quota for %s is exceeded", err.Period.Name, err.Resource)
+}
+
+// UsageBackend stores usage counters per subject and period
+type UsageBackend interface {
+	Add(subject string, usage Usage, periods []UsagePeriod) error
+	Get(subject string, periods []UsagePeriod) ([]Usage, error)
+}
+
+type UsageTracker struct {
+	Backend UsageBackend
+}
+
+type UsageReport struct {
+	UsagePeriod
+	Usage Usage      `json:"usage"`
+	Quota UsageQuota `json:"quota"`
+}
+
+var usageTracker *UsageTracker
+
+func (usage *Usage) Add(other Usage) {
+	usage.Runs += other.Runs
+	usage.ContainerSeconds += other.ContainerSeconds
+	usage.MemorySeconds += other.MemorySeconds
+	usage.OutputBytes += other.OutputBytes
+}
+
+// Override returns the quota with non-zero values of other applied
+func (quota UsageQuota) Override(other *UsageQuota) UsageQuota {
+	if other == nil {
+		return quota
+	}
+
+	if other.ContainerSeconds > 0 {
+		quota.ContainerSeconds = other.ContainerSeconds
+	}
+
+	if other.MemorySeconds > 0 {
+		quota.MemorySeconds = other.MemorySeconds
+	}
+
+	if other.OutputBytes > 0 {
+		quota.OutputBytes = other.OutputBytes
+	}
+
+	return quota
+}
+
+// Exceeded returns the name of the first exhausted resource
+func (quota UsageQuota) Exceeded(usage Usage) string {
+	if quota.ContainerSeconds > 0 && usage.ContainerSeconds >= quota.ContainerSeconds {
+		return "container_seconds"
+	}
+
+	if quota.MemorySeconds > 0 && usage.MemorySeconds >= quota.MemorySeconds {
+		return "memory_seconds"
+	}
+
+	if quota.OutputBytes > 0 && usage.OutputBytes >= quota.OutputBytes {
+		return "output_bytes"
+	}
+
+	return ""
+}
+
+func usagePeriods(now time.Time) []UsagePeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return []UsagePeriod{
+		{Name: "daily", Id: day.Format("2006-01-02"), Reset: day.AddDate(0, 0, 1)},
+		{Name: "monthly", Id: month.Format("2006-01"), Reset: month.AddDate(0, 1, 0)},
+	}
+}
+
+// usageSubject returns the id usage is accounted to, usage of anonymous
+// requests outside of namespaces is not tracked
+func usageSubject(key *ApiKey, namespace string) string {
+	if key != nil {
+		return "key:" + key.Id
+	}
+
+	if namespace != "" {
+		return "ns:" + namespace
+	}
+
+	return ""
+}
+
+// usageQuotas returns daily and monthly quotas, api keys override config defaults
+func usageQuotas(config *Config, key *ApiKey) []UsageQuota {
+	daily, monthly := config.UsageDaily, config.UsageMonthly
+
+	if key != nil {
+		daily = daily.Override(key.DailyQuota)
+		monthly = monthly.Override(key.MonthlyQuota)
+	}
+
+	return []UsageQuota{daily, monthly}
+}
+
+// runUsage measures resources consumed by a run that took elapsed time
+func runUsage(run *Run, result *RunResult, elapsed time.Duration) Usage {
+	usage := Usage{
+		Runs:             1,
+		ContainerSeconds: elapsed.Seconds(),
+		MemorySeconds:    float64(run.MemoryLimit()) / 1048576 * elapsed.Seconds(),
+	}
+
+	if result != nil {
+		usage.OutputBytes = int64(len(result.Output))
+	}
+
+	return usage
+}
+
+// NewUsageTracker stores usage in redis when it is used for throttling
+func NewUsageTracker(config *Config) (*UsageTracker, error) {
+	if config.ThrottleBackend == "redis" {
+		client := NewRedisClient(config.RedisAddress, config.RedisPassword, config.RedisDB)
+		return &UsageTracker{Backend: NewRedisUsageBackend(client, config.RedisPrefix)}, nil
+	}
+
+	backend, err := NewMemoryUsageBackend(config.UsagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend.Path != "" {
+		backend.StartPeriodicFlush()
+	}
+
+	return &UsageTracker{Backend: backend}, nil
+}
+
+// Check returns QuotaError when subject has exhausted any of its quotas
+func (t *UsageTracker) Check(subject string, quotas []UsageQuota) error {
+	if t == nil || subject == "" {
+		return nil
+	}
+
+	periods := usagePeriods(time.Now())
+
+	usage, err := t.Backend.Get(subject, periods)
+	if err != nil {
+		return err
+	}
+
+	for i, period := range periods {
+		if resource := quotas[i].Exceeded(usage[i]); resource != "" {
+			return &QuotaError{Period: period, Resource: resource}
+		}
+	}
+
+	return nil
+}
+
+func (t *UsageTracker) Record(subject string, usage Usage) {
+	if t == nil || subject == "" {
+		return
+	}
+
+	if err := t.Backend.Add(subject, usage, usagePeriods(time.Now())); err != nil {
+		logger.Error("cant record usage", "subject", subject, "error", err)
+	}
+}
+
+// Flush persists usage kept in memory, e.g. before shutdown
+func (t *UsageTracker) Flush() {
+	if t == nil {
+		return
+	}
+
+	if backend, ok := t.Backend.(*MemoryUsageBackend); ok {
+		if err := backend.Flush(); err != nil {
+			logger.Error("cant save usage", "error", err)
+		}
+	}
+}
+
+func (t *UsageTracker) Report(subject string, quotas []UsageQuota) ([]UsageReport, error) {
+	periods := usagePeriods(time.Now())
+
+	usage, err := t.Backend.Get(subject, periods)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]UsageReport, len(periods))
+	for i, period := range periods {
+		reports[i] = UsageReport{UsagePeriod: period, Usage: usage[i], Quota: quotas[i]}
+	}
+
+	return reports, nil
+}
+
+type UsageRecord struct {
+	Subject string    `json:"subject"`
+	Period  string    `json:"period"`
+	Expires time.Time `json:"expires"`
+	Usage
+}
+
+// MemoryUsageBackend keeps usage in process memory, optionally persisting
+// it to a JSON file so quotas survive restarts. Changes are written in the
+// background instead of on every run.
+type MemoryUsageBackend struct {
+	Path    string
+	records map[string]*UsageRecord
+	dirty   bool
+	sync.Mutex
+}
+
+const usageFlushInterval = 10 * time.Second
+
+func NewMemoryUsageBackend(path string) (*MemoryUsageBackend, error) {
+	backend := &MemoryUsageBackend{
+		records: map[string]*UsageRecord{},
+	}
+
+	if path == "" {
+		return backend, nil
+	}
+
+	backend.Path = expandPath(path)
+
+	data, err := ioutil.ReadFile(backend.Path)
+	if os.IsNotExist(err) {
+		return backend, nil
+	}
+	if err != nil {
+		return backend, err
+	}
+
+	records := []*UsageRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return backend, err
+	}
+
+	for _, record := range records {
+		backend.records[record.Subject+" "+record.Period] = record
+	}
+
+	return backend, nil
+}
+
+func (m *MemoryUsageBackend) Add(subject string, usage Usage, periods []UsagePeriod) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+
+	for id, record := range m.records {
+		if record.Expires.Before(now) {
+			delete(m.records, id)
+		}
+	}
+
+	for _, period := range periods {
+		id := subject + " " + period.Id
+
+		record := m.records[id]
+		if record == nil {
+			record = &UsageRecord{Subject: subject, Period: period.Id, Expires: period.Reset}
+			m.records[id] = record
+		}
+
+		record.Usage.Add(usage)
+	}
+
+	m.dirty = true
+	return nil
+}
+
+func (m *MemoryUsageBackend) Get(subject string, periods []UsagePeriod) ([]Usage, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := make([]Usage, len(periods))
+
+	for i, period := range periods {
+		if record := m.records[subject+" "+period.Id]; record != nil {
+			result[i] = record.Usage
+		}
+	}
+
+	return result, nil
+}
+
+// Flush writes records to the file when they changed since the last flush
+func (m *MemoryUsageBackend) Flush() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.dirty {
+		return nil
+	}
+
+	if err := m.save(); err != nil {
+		return err
+	}
+
+	m.dirty = false
+	return nil
+}
+
+func (m *MemoryUsageBackend) StartPeriodicFlush() {
+	go func() {
+		for {
+			time.Sleep(usageFlushInterval)
+
+			if err := m.Flush(); err != nil {
+				logger.Error("cant save usage", "error", err)
+			}
+		}
+	}()
+}
+
+// save writes records to a temporary file and renames it, caller must hold the lock
+func (m *MemoryUsageBackend) save() error {
+	if m.Path == "" {
+		return nil
+	}
+
+	records := []*UsageRecord{}
+	for _, record := range m.records {
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Subject != records[j].Subject {
+			return records[i].Subject < records[j].Subject
+		}
+		return records[i].Period < records[j].Period
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := m.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, m.Path)
+}
+
+// RedisUsageBackend shares usage between API instances. Counters are kept
+// as integers: seconds are stored in milliseconds.
+type RedisUsageBackend struct {
+	Client *RedisClient
+	Prefix string
+}
+
+var redisUsageFields = []string{"runs", "container_ms", "memory_ms", "output_bytes"}
+
+func NewRedisUsageBackend(client *RedisClient, prefix string) *RedisUsageBackend {
+	return &RedisUsageBackend{
+		Client: client,
+		Prefix: prefix,
+	}
+}
+
+func (r *RedisUsageBackend) key(subject string, period UsagePeriod, field string) string {
+	return r.Prefix + "usage:" + subject + ":" + period.Id + ":" + field
+}
+
+func (r *RedisUsageBackend) Add(subject string, usage Usage, periods []UsagePeriod) error {
+	values := []int64{
+		usage.Runs,
+		int64(usage.ContainerSeconds * 1000),
+		int64(usage.MemorySeconds * 1000),
+		usage.OutputBytes,
+	}
+
+	timeout := r.Client.Timeout
+
+	return r.Client.With(func(conn *redisConn) error {
+		if _, err := conn.Do(timeout, "MULTI"); err != nil {
+			return err
+		}
+
+		if err := r.queueAdd(conn, subject, values, periods); err != nil {
+			conn.Do(timeout, "DISCARD")
+			return err
+		}
+
+		_, err := conn.Do(timeout, "EXEC")
+		return err
+	})
+}
+
+// queueAdd queues counter updates inside a transaction
+func (r *RedisUsageBackend) queueAdd(conn *redisConn, subject string, values []int64, periods []UsagePeriod) error {
+	timeout := r.Client.Timeout
+
+	for _, period := range periods {
+		// Keep counters for a day after the period ends
+		ttl := time.Until(period.Reset) + time.Hour*24
+
+		for i, field := range redisUsageFields {
+			key := r.key(subject, period, field)
+
+			if _, err := conn.Do(timeout, "INCRBY", key, strconv.FormatInt(values[i], 10)); err != nil {
+				return err
+			}
+
+			if _, err := conn.Do(timeout, "PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *RedisUsageBackend) Get(subject string, periods []UsagePeriod) ([]Usage, error) {
+	args := []string{"MGET"}
+	for _, period := range periods {
+		for _, field := range redisUsageFields {
+			args = append(args, r.key(subject, period, field))
+		}
+	}
+
+	reply, err := r.Client.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != len(args)-1 {
+		return nil, fmt.Errorf("Invalid redis reply")
+	}
+
+	values := make([]int64, len(items))
+	for i, item := range items {
+		if str, ok := item.(string); ok {
+			values[i], _ = strconv.ParseInt(str, 10, 64)
+		}
+	}
+
+	result := make([]Usage, len(periods))
+	for i := range periods {
+		v := values[i*len(redisUsageFields):]
+
+		result[i] = Usage{
+			Runs:             v[0],
+			ContainerSeconds: float64(v[1]) / 1000,
+			MemorySeconds:    float64(v[2]) / 1000,
+			OutputBytes:      v[3],
+		}
+	}
+
+	return result, nil
+}
+
+// checkUsage responds with 429 and returns false when subject has exhausted
+// its quotas. Runs are let through when usage could not be fetched.
+func checkUsage(c *gin.Context, subject string, quotas []UsageQuota) bool {
+	err := usageTracker.Check(subject, quotas)
+	if err == nil {
+		return true
+	}
+
+	quotaErr, ok := err.(*QuotaError)
+	if !ok {
+		logger.Error("usage check failed", "subject", subject, "error", err)
+		return true
+	}
+
+	quotaRejections.Inc(quotaErr.Period.Name)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(quotaErr.Period.Reset).Seconds()))))
+	errorResponse(429, err, c)
+
+	return false
+}
+
+func HandleUsage(c *gin.Context) {
+	key := getApiKey(c)
+	namespace := normalizeString(c.Request.FormValue("namespace"))
+
+	// Keys only see their own usage, namespaces are shared so their usage
+	// is only reported to admins
+	if key != nil {
+		namespace = ""
+	} else if namespace != "" && !isAdmin(c) {
+		errorResponse(403, fmt.Errorf("Namespace usage is only available to admins"), c)
+		return
+	}
+
+	subject := usageSubject(key, namespace)
+	if subject == "" {
+		errorResponse(400, fmt.Errorf("Usage is tracked per api key or namespace"), c)
+		return
+	}
+
+	if usageTracker == nil {
+		errorResponse(404, fmt.Errorf("Usage tracking is not enabled"), c)
+		return
+	}
+
+	reports, err := usageTracker.Report(subject, usageQuotas(CurrentConfig(), key))
+	if err != nil {
+		errorResponse(400, err, c)
+		return
+	}
+
+	c.JSON(200, map[string]interface{}{
+		"subject": subject,
+		"daily":   reports[0],
+		"monthly": reports[1],
+	})
+}
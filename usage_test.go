@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+func TestMemoryUsageBackendFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	backend, err := NewMemoryUsageBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	periods := usagePeriods(time.Now())
+	if err := backend.Add("key:abc", Usage{Runs: 1, OutputBytes: 10}, periods); err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs only change memory, the file is written on flush
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected usage not to be written on add, got %v", err)
+	}
+
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewMemoryUsageBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, _ := loaded.Get("key:abc", periods)
+	if usage[0].Runs != 1 || usage[1].OutputBytes != 10 {
+		t.Errorf("expected flushed usage to be loaded, got %+v", usage)
+	}
+}
+
+func TestHandleUsageNamespace(t *testing.T) {
+	prev := usageTracker
+	usageTracker = &UsageTracker{Backend: &MemoryUsageBackend{records: map[string]*UsageRecord{}}}
+	prevConfig := CurrentConfig()
+	SetCurrentConfig(NewConfig())
+	t.Cleanup(func() {
+		usageTracker = prev
+		SetCurrentConfig(prevConfig)
+	})
+
+	examples := []struct {
+		name    string
+		admin   bool
+		key     *ApiKey
+		status  int
+		subject string
+	}{
+		{"anonymous", false, nil, 403, ""},
+		{"admin", true, nil, 200, "ns:docs"},
+		// Keys get their own usage, even when they belong to the namespace
+		{"api key", false, &ApiKey{Id: "abc", Namespace: "docs"}, 200, "key:abc"},
+	}
+
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/v1/usage?namespace=docs", nil)
+
+		if ex.admin {
+			c.Set("admin", true)
+		}
+		if ex.key != nil {
+			c.Set("api_key", ex.key)
+		}
+
+		HandleUsage(c)
+
+		if w.Code != ex.status {
+			t.Errorf("%s: expected status %d, got %d", ex.name, ex.status, w.Code)
+		}
+
+		if ex.subject != "" && !strings.Contains(w.Body.String(), `"subject":"`+ex.subject+`"`) {
+			t.Errorf("%s: expected subject %s, got %s", ex.name, ex.subject, w.Body.String())
+		}
+	}
+}